@@ -0,0 +1,114 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// Failure is an output of an index whose listing couldn't be fetched.
+type Failure struct {
+	PkgName   string    `json:"pkg_name"`
+	Outname   string    `json:"out_name"`
+	Outhash   string    `json:"out_hash"`
+	StoreName string    `json:"store_name"`
+	Version   string    `json:"version"`
+	Reason    string    `json:"reason"`
+	Date      time.Time `json:"date"`
+}
+
+// failureCursor is the position in the list of failures.
+type failureCursor struct {
+	PkgName string `json:"p"`
+	Hash    string `json:"h"`
+}
+
+// InsertFailure records an output of the index which couldn't be fetched, so that it isn't mistaken for an output without files.
+func (db *DB) InsertFailure(id, name, out, hash, storeName, version, reason string) error {
+	const query = `INSERT OR REPLACE INTO index_failures (index_uuid, pkg_name, output_name, output_hash, store_name, version, reason, failed)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	if _, err := db.db.Exec(query, id, name, out, hash, storeName, version, reason, time.Now()); err != nil {
+		return fmt.Errorf("inserting failure: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteFailure removes the failure of an output, used after it was indexed successfully.
+func (db *DB) DeleteFailure(id, name, hash string) error {
+	const query = `DELETE FROM index_failures WHERE index_uuid = $1 AND pkg_name = $2 AND output_hash = $3`
+	if _, err := db.db.Exec(query, id, name, hash); err != nil {
+		return fmt.Errorf("deleting failure: %w", err)
+	}
+
+	return nil
+}
+
+// Failures returns a page of the failed outputs of an index ordered by the package name.
+func (db *DB) Failures(id string, page PageRequest) (Page[Failure], error) {
+	result := Page[Failure]{Items: make([]Failure, 0)}
+	if page.Sort != "" && page.Sort != SortPkgName {
+		return result, ErrBadSort
+	}
+
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM index_failures WHERE index_uuid = $1`, id).Scan(&result.Total); err != nil {
+		return result, fmt.Errorf("counting failures: %w", err)
+	}
+
+	args := queryArgs{}
+	where := "index_uuid = " + args.add(id)
+	if page.Cursor != "" {
+		after := failureCursor{}
+		if err := decodeCursor(page.Cursor, &after); err != nil {
+			return result, err
+		}
+		where += fmt.Sprintf(" AND (pkg_name, output_hash) > (%s, %s)", args.add(after.PkgName), args.add(after.Hash))
+	}
+
+	limit := page.limit()
+	query := `SELECT pkg_name, output_name, output_hash, store_name, version, reason, failed FROM index_failures
+	WHERE ` + where + ` ORDER BY pkg_name, output_hash LIMIT ` + args.add(limit+1)
+	items, err := db.scanFailures(query, args...)
+	if err != nil {
+		return result, err
+	}
+
+	if len(items) > limit {
+		items = items[:limit]
+		last := items[limit-1]
+		result.NextCursor = encodeCursor(failureCursor{PkgName: last.PkgName, Hash: last.Outhash})
+	}
+
+	result.Items = items
+	return result, nil
+}
+
+// FailedOutputs returns every failed output of an index.
+func (db *DB) FailedOutputs(id string) ([]Failure, error) {
+	const query = `SELECT pkg_name, output_name, output_hash, store_name, version, reason, failed FROM index_failures
+	WHERE index_uuid = $1 ORDER BY pkg_name, output_hash`
+	return db.scanFailures(query, id)
+}
+
+// scanFailures runs a query returning failure rows.
+func (db *DB) scanFailures(query string, args ...any) ([]Failure, error) {
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("listing failures: %w", err)
+	}
+	defer rows.Close()
+
+	result := make([]Failure, 0)
+	for rows.Next() {
+		failure := Failure{}
+		if err := rows.Scan(&failure.PkgName, &failure.Outname, &failure.Outhash, &failure.StoreName, &failure.Version, &failure.Reason, &failure.Date); err != nil {
+			return nil, fmt.Errorf("scanning failure rows: %w", err)
+		}
+		result = append(result, failure)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("listing failures: %w", err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,500 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+var errUnmetRequirement = errors.New("requirement not met")
+
+// Migration is a single versioned change of the database schema.
+type Migration struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+
+	apply    func(tx *sql.Tx) error
+	requires func(tx *sql.Tx) error // Optional check, the migration stays pending while it fails
+}
+
+// migrations are the schema changes in the order they are applied. Every migration has to be idempotent,
+// databases created before the schema was versioned run all of them. Never change an existing migration, add a new one instead.
+// A migration with unmet requirements is skipped and retried on the next start, the ones after it still apply.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create the listings and user tables",
+		apply: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS listings (
+				index_channel VARCHAR(255) NOT NULL,
+				index_date DATE NOT NULL,
+				index_uuid CHAR(36) NOT NULL,
+				pkg_name VARCHAR(255) NOT NULL,
+				output_name VARCHAR(255) NOT NULL,
+				output_hash VARCHAR(255) NOT NULL,
+				version VARCHAR(50) NOT NULL,
+				fullpath VARCHAR(255) NOT NULL,
+				filename VARCHAR(255) NOT NULL,
+				PRIMARY KEY (pkg_name, index_uuid, output_hash, fullpath)
+			);
+
+			CREATE TABLE IF NOT EXISTS users (
+				username VARCHAR(255) PRIMARY KEY NOT NULL,
+				password VARCHAR(255) NOT NULL
+			);
+
+			CREATE TABLE IF NOT EXISTS users_history (
+				username VARCHAR(255) NOT NULL,
+				date DATE NOT NULL,
+				pkg_name VARCHAR(255) NOT NULL,
+				index_uuid CHAR(36) NOT NULL,
+				output_hash VARCHAR(255) NOT NULL,
+				fullpath VARCHAR(255) NOT NULL,
+				FOREIGN KEY (username) REFERENCES users(user_id),
+				FOREIGN KEY (pkg_name, index_uuid, output_hash, fullpath) REFERENCES listings(pkg_name, index_uuid, output_hash, fullpath)
+			);
+			`)
+			return err
+		},
+	},
+	{
+		Version:     2,
+		Description: "create the indices table with the output filter of every index",
+		apply: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS indices (
+				index_uuid CHAR(36) PRIMARY KEY NOT NULL,
+				index_channel VARCHAR(255) NOT NULL,
+				index_date DATE NOT NULL,
+				outputs VARCHAR(255) NOT NULL
+			);
+			`)
+			if err != nil {
+				return err
+			}
+
+			if !tableExists(tx, "listings") {
+				return nil
+			}
+
+			_, err = tx.Exec(`
+			INSERT OR IGNORE INTO indices (index_uuid, index_channel, index_date, outputs)
+				SELECT index_uuid, index_channel, MIN(index_date), 'dev' FROM listings GROUP BY index_uuid;
+			`)
+			return err
+		},
+	},
+	{
+		Version:     3,
+		Description: "move the listings into content addressed output tables",
+		apply: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS outputs (
+				output_hash VARCHAR(255) PRIMARY KEY NOT NULL,
+				file_count INTEGER NOT NULL
+			);
+
+			CREATE TABLE IF NOT EXISTS files (
+				output_hash VARCHAR(255) NOT NULL,
+				fullpath VARCHAR(255) NOT NULL,
+				filename VARCHAR(255) NOT NULL,
+				PRIMARY KEY (output_hash, fullpath),
+				FOREIGN KEY (output_hash) REFERENCES outputs(output_hash)
+			);
+
+			CREATE INDEX IF NOT EXISTS files_filename ON files (filename);
+			CREATE INDEX IF NOT EXISTS files_fullpath ON files (fullpath);
+
+			CREATE TABLE IF NOT EXISTS index_outputs (
+				index_uuid CHAR(36) NOT NULL,
+				pkg_name VARCHAR(255) NOT NULL,
+				output_name VARCHAR(255) NOT NULL,
+				output_hash VARCHAR(255) NOT NULL,
+				version VARCHAR(50) NOT NULL,
+				PRIMARY KEY (index_uuid, pkg_name, output_hash),
+				FOREIGN KEY (index_uuid) REFERENCES indices(index_uuid),
+				FOREIGN KEY (output_hash) REFERENCES outputs(output_hash)
+			);
+
+			CREATE INDEX IF NOT EXISTS index_outputs_hash ON index_outputs (output_hash);
+			`)
+			if err != nil {
+				return err
+			}
+
+			if !tableExists(tx, "listings") {
+				return nil
+			}
+
+			_, err = tx.Exec(`
+			INSERT OR IGNORE INTO files (output_hash, fullpath, filename)
+				SELECT DISTINCT output_hash, fullpath, filename FROM listings;
+
+			INSERT OR IGNORE INTO outputs (output_hash, file_count)
+				SELECT output_hash, COUNT(*) FROM files GROUP BY output_hash;
+
+			INSERT OR IGNORE INTO index_outputs (index_uuid, pkg_name, output_name, output_hash, version)
+				SELECT DISTINCT index_uuid, pkg_name, output_name, output_hash, version FROM listings;
+
+			ALTER TABLE users_history RENAME TO users_history_old;
+
+			CREATE TABLE users_history (
+				username VARCHAR(255) NOT NULL,
+				date DATE NOT NULL,
+				pkg_name VARCHAR(255) NOT NULL,
+				index_uuid CHAR(36) NOT NULL,
+				output_hash VARCHAR(255) NOT NULL,
+				fullpath VARCHAR(255) NOT NULL,
+				FOREIGN KEY (username) REFERENCES users(user_id),
+				FOREIGN KEY (index_uuid, pkg_name, output_hash) REFERENCES index_outputs(index_uuid, pkg_name, output_hash)
+			);
+
+			INSERT INTO users_history SELECT * FROM users_history_old;
+
+			DROP TABLE users_history_old;
+			DROP TABLE listings;
+			`)
+			return err
+		},
+	},
+	{
+		Version:     4,
+		Description: "give the files stable row ids",
+		apply: func(tx *sql.Tx) error {
+			if columnExists(tx, "files", "file_id") {
+				return nil
+			}
+
+			_, err := tx.Exec(`
+			CREATE TABLE files_new (
+				file_id INTEGER PRIMARY KEY,
+				output_hash VARCHAR(255) NOT NULL,
+				fullpath VARCHAR(255) NOT NULL,
+				filename VARCHAR(255) NOT NULL,
+				UNIQUE (output_hash, fullpath),
+				FOREIGN KEY (output_hash) REFERENCES outputs(output_hash)
+			);
+
+			INSERT INTO files_new (output_hash, fullpath, filename) SELECT output_hash, fullpath, filename FROM files;
+
+			DROP TABLE files;
+			ALTER TABLE files_new RENAME TO files;
+
+			CREATE INDEX IF NOT EXISTS files_filename ON files (filename);
+			CREATE INDEX IF NOT EXISTS files_fullpath ON files (fullpath);
+			`)
+			return err
+		},
+	},
+	{
+		Version:     5,
+		Description: "create the trigram search index over the file paths",
+		requires: func(tx *sql.Tx) error {
+			enabled := false
+			if err := tx.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&enabled); err != nil {
+				return err
+			}
+
+			if !enabled {
+				return errors.New("sqlite was built without FTS5, build with `-tags sqlite_fts5` to enable fast glob and substring search")
+			}
+
+			return nil
+		},
+		apply: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+			CREATE VIRTUAL TABLE IF NOT EXISTS files_search USING fts5(fullpath, content = 'files', content_rowid = 'file_id', tokenize = 'trigram');
+
+			CREATE TRIGGER IF NOT EXISTS files_search_insert AFTER INSERT ON files BEGIN
+				INSERT INTO files_search (rowid, fullpath) VALUES (new.file_id, new.fullpath);
+			END;
+
+			CREATE TRIGGER IF NOT EXISTS files_search_delete AFTER DELETE ON files BEGIN
+				INSERT INTO files_search (files_search, rowid, fullpath) VALUES ('delete', old.file_id, old.fullpath);
+			END;
+
+			INSERT INTO files_search (files_search) VALUES ('rebuild');
+			`)
+			return err
+		},
+	},
+	{
+		Version:     6,
+		Description: "record the store path names of the outputs",
+		apply: func(tx *sql.Tx) error {
+			if columnExists(tx, "outputs", "store_name") {
+				return nil
+			}
+
+			_, err := tx.Exec(`ALTER TABLE outputs ADD COLUMN store_name VARCHAR(255) NOT NULL DEFAULT ''`)
+			return err
+		},
+	},
+	{
+		Version:     7,
+		Description: "record the type, size, executable bit and symlink target of the files",
+		apply: func(tx *sql.Tx) error {
+			if columnExists(tx, "files", "type") {
+				return nil
+			}
+
+			_, err := tx.Exec(`
+			ALTER TABLE files ADD COLUMN type VARCHAR(16) NOT NULL DEFAULT 'regular';
+			ALTER TABLE files ADD COLUMN size INTEGER NOT NULL DEFAULT 0;
+			ALTER TABLE files ADD COLUMN executable BOOLEAN NOT NULL DEFAULT FALSE;
+			ALTER TABLE files ADD COLUMN target VARCHAR(255) NOT NULL DEFAULT '';
+			`)
+			return err
+		},
+	},
+	{
+		Version:     8,
+		Description: "record the outputs which failed to be indexed",
+		apply: func(tx *sql.Tx) error {
+			_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS index_failures (
+				index_uuid CHAR(36) NOT NULL,
+				pkg_name VARCHAR(255) NOT NULL,
+				output_name VARCHAR(255) NOT NULL,
+				output_hash VARCHAR(255) NOT NULL,
+				store_name VARCHAR(255) NOT NULL,
+				version VARCHAR(50) NOT NULL,
+				reason TEXT NOT NULL,
+				failed DATETIME NOT NULL,
+				PRIMARY KEY (index_uuid, pkg_name, output_hash),
+				FOREIGN KEY (index_uuid) REFERENCES indices(index_uuid)
+			);
+			`)
+			return err
+		},
+	},
+	{
+		Version:     9,
+		Description: "record the binary cache which served each indexed output",
+		apply: func(tx *sql.Tx) error {
+			if columnExists(tx, "index_outputs", "cache_url") {
+				return nil
+			}
+
+			_, err := tx.Exec(`ALTER TABLE index_outputs ADD COLUMN cache_url VARCHAR(255) NOT NULL DEFAULT ''`)
+			return err
+		},
+	},
+	{
+		Version:     10,
+		Description: "store the narinfo metadata and the references of the outputs",
+		apply: func(tx *sql.Tx) error {
+			if !columnExists(tx, "outputs", "nar_size") {
+				_, err := tx.Exec(`
+				ALTER TABLE outputs ADD COLUMN nar_size INTEGER NOT NULL DEFAULT 0;
+				ALTER TABLE outputs ADD COLUMN file_size INTEGER NOT NULL DEFAULT 0;
+				ALTER TABLE outputs ADD COLUMN deriver VARCHAR(255) NOT NULL DEFAULT '';
+				ALTER TABLE outputs ADD COLUMN compression VARCHAR(16) NOT NULL DEFAULT '';
+				ALTER TABLE outputs ADD COLUMN sigs TEXT NOT NULL DEFAULT '';
+				`)
+				if err != nil {
+					return err
+				}
+			}
+
+			_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS output_references (
+				output_hash VARCHAR(255) NOT NULL,
+				reference_hash VARCHAR(255) NOT NULL,
+				reference VARCHAR(255) NOT NULL,
+				PRIMARY KEY (output_hash, reference_hash),
+				FOREIGN KEY (output_hash) REFERENCES outputs(output_hash)
+			);
+
+			CREATE INDEX IF NOT EXISTS output_references_reference ON output_references (reference_hash);
+			`)
+			return err
+		},
+	},
+	{
+		Version:     11,
+		Description: "record the nar hashes and the signature verification of the indexed outputs",
+		apply: func(tx *sql.Tx) error {
+			if !columnExists(tx, "outputs", "nar_hash") {
+				if _, err := tx.Exec(`ALTER TABLE outputs ADD COLUMN nar_hash VARCHAR(255) NOT NULL DEFAULT ''`); err != nil {
+					return err
+				}
+			}
+
+			if !columnExists(tx, "index_outputs", "verified") {
+				if _, err := tx.Exec(`ALTER TABLE index_outputs ADD COLUMN verified BOOLEAN NOT NULL DEFAULT FALSE`); err != nil {
+					return err
+				}
+			}
+
+			if !columnExists(tx, "indices", "verify") {
+				if _, err := tx.Exec(`ALTER TABLE indices ADD COLUMN verify VARCHAR(16) NOT NULL DEFAULT 'off'`); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		Version:     12,
+		Description: "record the system of the indexed channel, the older channels were always fetched for x86_64-linux",
+		apply: func(tx *sql.Tx) error {
+			if columnExists(tx, "indices", "system") {
+				return nil
+			}
+
+			_, err := tx.Exec(`ALTER TABLE indices ADD COLUMN system VARCHAR(50) NOT NULL DEFAULT 'x86_64-linux'`)
+			return err
+		},
+	},
+}
+
+// SchemaVersion returns the version up to which every migration has been applied, 0 means an unversioned database.
+// A skipped migration keeps the version below it even if the later migrations were applied, use PendingMigrations to list them.
+func (db *DB) SchemaVersion() (int, error) {
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	version := 0
+	for _, m := range migrations {
+		if !applied[m.Version] {
+			break
+		}
+		version = m.Version
+	}
+
+	return version, nil
+}
+
+// PendingMigrations returns the migrations which have not been applied yet.
+func (db *DB) PendingMigrations() ([]Migration, error) {
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]Migration, 0)
+	for _, m := range migrations {
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending, nil
+}
+
+// appliedMigrations returns the versions of the applied migrations.
+func (db *DB) appliedMigrations() (map[int]bool, error) {
+	applied := make(map[int]bool)
+	exists := 0
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'`).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("checking schema version table: %w", err)
+	}
+
+	if exists == 0 {
+		return applied, nil
+	}
+
+	rows, err := db.db.Query(`SELECT version FROM schema_version`)
+	if err != nil {
+		return nil, fmt.Errorf("reading applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		version := 0
+		if err := rows.Scan(&version); err != nil {
+			return nil, fmt.Errorf("scanning applied migrations: %w", err)
+		}
+		applied[version] = true
+	}
+
+	return applied, nil
+}
+
+// Migrate applies the pending migrations in order, each one in its own transaction. Returns the applied migrations.
+func (db *DB) Migrate() ([]Migration, error) {
+	if _, err := db.db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY NOT NULL,
+		description VARCHAR(255) NOT NULL,
+		applied DATE NOT NULL
+	);
+	`); err != nil {
+		return nil, fmt.Errorf("creating schema version table: %w", err)
+	}
+
+	pending, err := db.PendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make([]Migration, 0, len(pending))
+	for _, m := range pending {
+		if err := db.applyMigration(m); err != nil {
+			if errors.Is(err, errUnmetRequirement) {
+				log.Warn("Skipping migration", "version", m.Version, "err", err)
+				continue
+			}
+
+			return applied, fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+		}
+		applied = append(applied, m)
+	}
+
+	return applied, nil
+}
+
+// applyMigration runs a migration and records it in the schema version table.
+func (db *DB) applyMigration(m Migration) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if m.requires != nil {
+		if err := m.requires(tx); err != nil {
+			return fmt.Errorf("%w: %w", errUnmetRequirement, err)
+		}
+	}
+
+	log.Info("Applying migration", "version", m.Version, "description", m.Description)
+	if err := m.apply(tx); err != nil {
+		return err
+	}
+
+	const query = `INSERT INTO schema_version (version, description, applied) VALUES ($1, $2, $3)`
+	if _, err := tx.Exec(query, m.Version, m.Description, time.Now()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// tableExists checks if a table is present in the database.
+func tableExists(tx *sql.Tx, name string) bool {
+	count := 0
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = $1`, name).Scan(&count); err != nil {
+		return false
+	}
+
+	return count != 0
+}
+
+// columnExists checks if a table has a column.
+func columnExists(tx *sql.Tx, table, column string) bool {
+	count := 0
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info($1) WHERE name = $2`, table, column).Scan(&count); err != nil {
+		return false
+	}
+
+	return count != 0
+}
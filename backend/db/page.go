@@ -0,0 +1,79 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Page sizes used when the caller doesn't specify one or asks for too much.
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// Sort keys for the lists of packages.
+const (
+	SortPkgName = "pkg_name"
+	SortVersion = "version"
+	SortPath    = "path"
+	SortDate    = "date"
+)
+
+var (
+	ErrBadCursor = errors.New("invalid cursor")
+	ErrBadSort   = errors.New("unknown sort key")
+)
+
+// PageRequest selects a part of a sorted list. The cursor is the one returned with the previous page, empty for the first one.
+type PageRequest struct {
+	Limit  int
+	Cursor string
+	Sort   string
+}
+
+// limit returns the clamped page size.
+func (req PageRequest) limit() int {
+	if req.Limit <= 0 {
+		return DefaultPageSize
+	}
+
+	return min(req.Limit, MaxPageSize)
+}
+
+// Page is a part of a list, the next cursor is empty on the last page.
+type Page[T any] struct {
+	Items      []T    `json:"items"`
+	Total      int    `json:"total"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// encodeCursor encodes the position of the last item in an opaque cursor.
+func encodeCursor(position any) string {
+	data, _ := json.Marshal(position)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor reads the position back from a cursor.
+func decodeCursor(cursor string, position any) error {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return ErrBadCursor
+	}
+
+	if err := json.Unmarshal(data, position); err != nil {
+		return ErrBadCursor
+	}
+
+	return nil
+}
+
+// queryArgs collects the positional arguments of a query which is built piece by piece.
+type queryArgs []any
+
+// add appends an argument and returns its placeholder.
+func (args *queryArgs) add(value any) string {
+	*args = append(*args, value)
+	return fmt.Sprintf("$%d", len(*args))
+}
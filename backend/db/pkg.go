@@ -1,8 +1,11 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"regexp"
 	"strings"
 	"time"
 
@@ -11,98 +14,618 @@ import (
 
 // PkgResult is a package query result from the index.
 type PkgResult struct {
-	PkgName string `json:"pkg_name"`
-	Outname string `json:"out_name"`
-	Outhash string `json:"out_hash"`
-	Path    string `json:"path"`
-	Version string `json:"version"`
+	PkgName    string   `json:"pkg_name"`
+	Outname    string   `json:"out_name"`
+	Outhash    string   `json:"out_hash"`
+	StorePath  string   `json:"store_path,omitempty"`
+	Path       string   `json:"path"`
+	Version    string   `json:"version"`
+	Type       string   `json:"type"`
+	Size       int64    `json:"size"`
+	Executable bool     `json:"executable"`
+	Target     string   `json:"target,omitempty"`
+	Cache      string   `json:"cache,omitempty"` // The substituter which served the listing
+	NarSize    int64    `json:"nar_size,omitempty"`
+	FileSize   int64    `json:"file_size,omitempty"` // The size of the compressed NAR
+	Deriver    string   `json:"deriver,omitempty"`
+	References []string `json:"references,omitempty"` // Base names of the referenced store paths
+	Verified   bool     `json:"verified"`             // The narinfo was signed by a trusted key
+}
+
+// OutputInfo is the narinfo metadata of an output.
+type OutputInfo struct {
+	NarHash     string
+	NarSize     int64
+	FileSize    int64
+	References  []string // Base names of the referenced store paths, for example qzh70f91a8sc1kb0n9hbf52hcv3jgy68-glibc-2.40
+	Deriver     string
+	Compression string
+	Sigs        []string
+}
+
+// File is a file of an output.
+type File struct {
+	Path       string
+	Type       string // Either regular or symlink
+	Size       int64
+	Executable bool
+	Target     string // The target of a symlink
+}
+
+// VerifyMode is the strictness of the narinfo signature verification of an index.
+type VerifyMode string
+
+const (
+	VerifyOff    VerifyMode = "off"    // Signatures aren't checked
+	VerifyFlag   VerifyMode = "flag"   // Outputs are indexed and marked as verified or not
+	VerifyStrict VerifyMode = "strict" // Outputs without a trusted signature are recorded as failures instead
+)
+
+// Valid checks if the mode is known.
+func (mode VerifyMode) Valid() bool {
+	return mode == VerifyOff || mode == VerifyFlag || mode == VerifyStrict
 }
 
 // IndexInfo is the short information about a previously created index, if the index was short lived, it should not be used.
 type IndexInfo struct {
-	ID        string    `json:"id"`
-	Date      time.Time `json:"date"`
-	FileCount int       `json:"total_file_count"`
+	ID        string     `json:"id"`
+	Date      time.Time  `json:"date"`
+	System    string     `json:"system"`
+	Outputs   []string   `json:"outputs"`
+	Verify    VerifyMode `json:"verify"`
+	FileCount int        `json:"total_file_count"`
+	Failures  int        `json:"failed_outputs"`
 }
 
-// ListIndices lists the available indices in the database.
-func (db *DB) ListIndices(channel string) ([]IndexInfo, error) {
-	rows, err := db.db.Query(`SELECT index_uuid, index_date, COUNT(*) FROM listings WHERE index_channel = $1 GROUP BY index_date ORDER BY index_date DESC`, channel)
+// indexCursor is the position in the list of indices.
+type indexCursor struct {
+	Date time.Time `json:"d"`
+	ID   string    `json:"i"`
+}
+
+// ListIndices lists the available indices in the database, newest first. An empty system matches indices of every system.
+// The indices can only be sorted by the date.
+func (db *DB) ListIndices(channel, system string, page PageRequest) (Page[IndexInfo], error) {
+	result := Page[IndexInfo]{Items: make([]IndexInfo, 0)}
+	if page.Sort != "" && page.Sort != SortDate {
+		return result, ErrBadSort
+	}
+
+	args := queryArgs{}
+	where := "i.index_channel = " + args.add(channel)
+	if system != "" {
+		where += " AND i.system = " + args.add(system)
+	}
+
+	if err := db.db.QueryRow(`SELECT COUNT(*) FROM indices i WHERE `+where, args...).Scan(&result.Total); err != nil {
+		return result, fmt.Errorf("counting indices: %w", err)
+	}
+
+	if page.Cursor != "" {
+		after := indexCursor{}
+		if err := decodeCursor(page.Cursor, &after); err != nil {
+			return result, err
+		}
+		where += fmt.Sprintf(" AND (i.index_date, i.index_uuid) < (%s, %s)", args.add(after.Date), args.add(after.ID))
+	}
+
+	limit := page.limit()
+	query := `SELECT i.index_uuid, i.index_date, i.system, i.outputs, i.verify, COALESCE(SUM(o.file_count), 0),
+	(SELECT COUNT(*) FROM index_failures fl WHERE fl.index_uuid = i.index_uuid)
+FROM indices i LEFT JOIN index_outputs io ON io.index_uuid = i.index_uuid LEFT JOIN outputs o ON o.output_hash = io.output_hash
+WHERE ` + where + ` GROUP BY i.index_uuid ORDER BY i.index_date DESC, i.index_uuid DESC LIMIT ` + args.add(limit+1)
+	rows, err := db.db.Query(query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("listing indices: %w", err)
+		return result, fmt.Errorf("listing indices: %w", err)
 	}
 	defer rows.Close()
 
-	indices := make([]IndexInfo, 0)
 	for rows.Next() {
 		index := IndexInfo{}
-		if err := rows.Scan(&index.ID, &index.Date, &index.FileCount); err != nil {
-			return nil, fmt.Errorf("scanning indices rows: %w", err)
+		outputs := ""
+		if err := rows.Scan(&index.ID, &index.Date, &index.System, &outputs, &index.Verify, &index.FileCount, &index.Failures); err != nil {
+			return result, fmt.Errorf("scanning indices rows: %w", err)
 		}
-		indices = append(indices, index)
+		index.Outputs = strings.Split(outputs, ",")
+		result.Items = append(result.Items, index)
+	}
+
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("listing indices: %w", err)
+	}
+
+	if len(result.Items) > limit {
+		result.Items = result.Items[:limit]
+		last := result.Items[limit-1]
+		result.NextCursor = encodeCursor(indexCursor{Date: last.Date, ID: last.ID})
 	}
 
-	return indices, nil
+	return result, nil
+}
+
+// ErrNoIndex is returned when the index doesn't exist or hasn't finished.
+var ErrNoIndex = errors.New("no index with this id")
+
+// IndexSettings returns the channel and the verification mode of a finished index.
+func (db *DB) IndexSettings(id string) (string, VerifyMode, error) {
+	channel := ""
+	verify := VerifyOff
+	err := db.db.QueryRow(`SELECT index_channel, verify FROM indices WHERE index_uuid = $1`, id).Scan(&channel, &verify)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", ErrNoIndex
+	}
+
+	if err != nil {
+		return "", "", fmt.Errorf("reading index: %w", err)
+	}
+
+	return channel, verify, nil
+}
+
+// IndexSystem returns the system of the packages of a finished index.
+func (db *DB) IndexSystem(id string) (string, error) {
+	system := ""
+	err := db.db.QueryRow(`SELECT system FROM indices WHERE index_uuid = $1`, id).Scan(&system)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNoIndex
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("reading index: %w", err)
+	}
+
+	return system, nil
+}
+
+// InsertIndex records a finished index along with the system of the channel, the output filter and the verification mode which were used to create it.
+func (db *DB) InsertIndex(indexDate time.Time, channel, system, id string, outputs []string, verify VerifyMode) error {
+	const query = `INSERT INTO indices (index_uuid, index_channel, system, index_date, outputs, verify) VALUES ($1, $2, $3, $4, $5, $6)`
+	if _, err := db.db.Exec(query, id, channel, system, indexDate, strings.Join(outputs, ","), verify); err != nil {
+		return fmt.Errorf("inserting index: %w", err)
+	}
+
+	return nil
+}
+
+// QueryMode selects how the query parameter is matched against the indexed paths.
+type QueryMode string
+
+const (
+	ModeExact     QueryMode = "exact"
+	ModeGlob      QueryMode = "glob"
+	ModeSubstring QueryMode = "substring"
+	ModeRegex     QueryMode = "regex"
+)
+
+// Limits protecting the database from expensive regex queries.
+const (
+	MaxRegexLength  = 256
+	MaxRegexResults = 1000
+	RegexTimeout    = 10 * time.Second
+)
+
+var (
+	ErrBadMode      = errors.New("unknown query mode")
+	ErrBadPattern   = errors.New("invalid pattern")
+	ErrQueryTimeout = errors.New("query took too long")
+)
+
+// pkgSortColumns maps the sort keys of the query results to columns.
+var pkgSortColumns = map[string]string{
+	"":          "io.pkg_name",
+	SortPkgName: "io.pkg_name",
+	SortVersion: "io.version",
+	SortPath:    "f.fullpath",
+}
+
+// pkgCursor is the position in the query results.
+type pkgCursor struct {
+	Key     string `json:"k"`
+	PkgName string `json:"p"`
+	Hash    string `json:"h"`
+	FileID  int64  `json:"f"`
+	Seen    int    `json:"n,omitempty"` // The number of results on the previous pages of a capped query
 }
 
-// QueryPkg the database using a parameter. The parameter may be in the following formats:
+// QueryPkg the database using a parameter. In the exact mode the parameter may be in the following formats:
 // - "/usr/lib/libc.so.6"
 // - "libc.so.6"
-// Returns a list of resulting packages.
-func (db DB) QueryPkg(id, param string) ([]PkgResult, error) {
-	const baseQuery = "SELECT pkg_name, output_name, output_hash, version, fullpath FROM listings"
-	log.Info("Querying index", "param", param)
-	fullPath := strings.Count(param, "/") > 1
-	query := ""
+// In the glob mode patterns without a slash match the file name, for example "libssl*", and the other ones match the path,
+// for example "share/*/pkgconfig/openssl.pc" or "*/bin/gcc". The substring mode matches any part of the path and the regex mode
+// matches the path against a regular expression, for example "lib/libpython3\.[0-9]+\.so", the total of a regex query is capped.
+// Returns a page of resulting packages sorted by the package name, version or path.
+func (db DB) QueryPkg(id, param string, mode QueryMode, page PageRequest) (Page[PkgResult], error) {
+	const from = "files f JOIN index_outputs io ON io.output_hash = f.output_hash JOIN outputs o ON o.output_hash = f.output_hash"
+	log.Info("Querying index", "param", param, "mode", mode)
+	result := Page[PkgResult]{Items: make([]PkgResult, 0)}
+
+	sortColumn, ok := pkgSortColumns[page.Sort]
+	if !ok {
+		return result, ErrBadSort
+	}
+
+	ctx := context.Background()
+	args := queryArgs{}
+	where := "io.index_uuid = " + args.add(id)
+	pattern := ""
+	countLimit := ""
+	maxResults := 0
+
+	switch mode {
+	case ModeExact, "":
+		if strings.Count(param, "/") > 1 {
+			where += " AND f.fullpath = " + args.add(param)
+		} else {
+			where += " AND f.filename = " + args.add(param)
+		}
+
+	case ModeGlob:
+		if !strings.Contains(param, "/") {
+			where += " AND f.filename GLOB " + args.add(param)
+			pattern = "*/" + param
+			break
+		}
+
+		// The paths start with a slash, a leading star already matches it
+		if !strings.HasPrefix(param, "/") && !strings.HasPrefix(param, "*") {
+			param = "/" + param
+		}
+		where += " AND f.fullpath GLOB " + args.add(param)
+		pattern = param
+
+	case ModeSubstring:
+		pattern = "*" + EscapeGlob(param) + "*"
+		where += " AND f.fullpath GLOB " + args.add(pattern)
+
+	case ModeRegex:
+		if len(param) > MaxRegexLength {
+			return result, fmt.Errorf("%w: longer than %d characters", ErrBadPattern, MaxRegexLength)
+		}
+
+		if _, err := regexp.Compile(param); err != nil {
+			return result, fmt.Errorf("%w: %w", ErrBadPattern, err)
+		}
+
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, RegexTimeout)
+		defer cancel()
+		where += " AND f.fullpath REGEXP " + args.add(param)
+		countLimit = fmt.Sprintf(" LIMIT %d", MaxRegexResults)
+		maxResults = MaxRegexResults
+
+	default:
+		return result, ErrBadMode
+	}
+
+	if db.search && pattern != "" {
+		// Let the trigram index narrow down the candidates instead of scanning every path
+		where += " AND f.file_id IN (SELECT rowid FROM files_search WHERE fullpath GLOB " + args.add(pattern) + ")"
+	}
+
+	countQuery := "SELECT COUNT(*) FROM (SELECT 1 FROM " + from + " WHERE " + where + countLimit + ")"
+	if err := db.db.QueryRowContext(ctx, countQuery, args...).Scan(&result.Total); err != nil {
+		if ctx.Err() != nil {
+			return result, ErrQueryTimeout
+		}
+		return result, err
+	}
+
+	keys := sortColumn + ", io.pkg_name, io.output_hash, f.file_id"
+	after := pkgCursor{}
+	if page.Cursor != "" {
+		if err := decodeCursor(page.Cursor, &after); err != nil {
+			return result, err
+		}
+		where += fmt.Sprintf(" AND (%s) > (%s, %s, %s, %s)", keys, args.add(after.Key), args.add(after.PkgName), args.add(after.Hash), args.add(after.FileID))
+	}
 
-	if fullPath {
-		query = baseQuery + " WHERE fullpath = $1 AND index_uuid = $2"
-	} else {
-		query = baseQuery + " WHERE filename = $1 AND index_uuid = $2"
+	// The pages of a capped query stop at the same number of results as the total
+	limit := page.limit()
+	if maxResults != 0 {
+		limit = min(limit, maxResults-after.Seen)
+		if limit <= 0 {
+			return result, nil
+		}
 	}
 
-	rows, err := db.db.Query(query, param, id)
+	query := "SELECT io.pkg_name, io.output_name, io.output_hash, o.store_name, io.version, io.cache_url, io.verified, o.nar_size, o.file_size, o.deriver, " +
+		"f.fullpath, f.type, f.size, f.executable, f.target, f.file_id, " + sortColumn +
+		" FROM " + from + " WHERE " + where + " ORDER BY " + keys + " LIMIT " + args.add(limit+1)
+	rows, err := db.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		if ctx.Err() != nil {
+			return result, ErrQueryTimeout
+		}
+		return result, err
 	}
 	defer rows.Close()
 
-	return rowsToResult(rows)
+	last := pkgCursor{}
+	for len(result.Items) < limit && rows.Next() {
+		pkg := PkgResult{}
+		storeName := ""
+		if err := rows.Scan(
+			&pkg.PkgName, &pkg.Outname, &pkg.Outhash, &storeName, &pkg.Version, &pkg.Cache, &pkg.Verified, &pkg.NarSize, &pkg.FileSize, &pkg.Deriver, &pkg.Path, &pkg.Type, &pkg.Size, &pkg.Executable, &pkg.Target, &last.FileID, &last.Key,
+		); err != nil {
+			return result, err
+		}
+
+		if storeName != "" {
+			pkg.StorePath = "/nix/store/" + pkg.Outhash + "-" + storeName
+		}
+
+		last.PkgName = pkg.PkgName
+		last.Hash = pkg.Outhash
+		result.Items = append(result.Items, pkg)
+	}
+
+	more := len(result.Items) == limit && rows.Next()
+	if err := rows.Err(); err != nil {
+		if ctx.Err() != nil {
+			return result, ErrQueryTimeout
+		}
+		return result, err
+	}
+
+	if maxResults != 0 {
+		last.Seen = after.Seen + len(result.Items)
+		more = more && last.Seen < maxResults
+	}
+
+	if more {
+		result.NextCursor = encodeCursor(last)
+	}
+
+	if err := db.loadReferences(ctx, result.Items); err != nil {
+		if ctx.Err() != nil {
+			return result, ErrQueryTimeout
+		}
+		return result, err
+	}
+
+	return result, nil
+}
+
+// loadReferences fills in the references of the outputs of the results.
+func (db *DB) loadReferences(ctx context.Context, items []PkgResult) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	args := queryArgs{}
+	placeholders := make([]string, 0, len(items))
+	seen := make(map[string]bool)
+	for _, item := range items {
+		if !seen[item.Outhash] {
+			seen[item.Outhash] = true
+			placeholders = append(placeholders, args.add(item.Outhash))
+		}
+	}
+
+	query := "SELECT output_hash, reference FROM output_references WHERE output_hash IN (" + strings.Join(placeholders, ", ") + ") ORDER BY reference"
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("reading references: %w", err)
+	}
+	defer rows.Close()
+
+	references := make(map[string][]string)
+	for rows.Next() {
+		hash, reference := "", ""
+		if err := rows.Scan(&hash, &reference); err != nil {
+			return fmt.Errorf("scanning references: %w", err)
+		}
+		references[hash] = append(references[hash], reference)
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("reading references: %w", err)
+	}
+
+	for i := range items {
+		items[i].References = references[items[i].Outhash]
+	}
+
+	return nil
+}
+
+// EscapeGlob escapes the special characters of a GLOB pattern.
+func EscapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[':
+			b.WriteRune('[')
+			b.WriteRune(r)
+			b.WriteRune(']')
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
 }
 
-// InsertPkg puts the package information into the index.
-func (db *DB) InsertPkg(indexDate time.Time, channel, id, name, out, hash, version string, files []string) error {
-	const query = `INSERT INTO listings (index_channel, index_date, index_uuid, pkg_name, output_name,	output_hash, version, fullpath, filename)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+// InsertPkg puts the package information into the index along with the cache which served the listing and whether its signature
+// was verified. The files of an output are only stored once, no matter how many indices contain it. The narinfo metadata is optional.
+func (db *DB) InsertPkg(id, name, out, hash, storeName, version, cache string, verified bool, files []File, info *OutputInfo) error {
+	const outputQuery = `INSERT OR IGNORE INTO outputs (output_hash, file_count, store_name) VALUES ($1, $2, $3)`
+	const fileQuery = `INSERT OR IGNORE INTO files (output_hash, fullpath, filename, type, size, executable, target) VALUES ($1, $2, $3, $4, $5, $6, $7)`
 
 	tx, err := db.db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(outputQuery, hash, len(files), storeName)
+	if err != nil {
+		return err
+	}
+
+	if inserted, _ := res.RowsAffected(); inserted != 0 {
+		for _, file := range files {
+			split := strings.Split(file.Path, "/")
+			filename := split[len(split)-1]
+			if _, err := tx.Exec(fileQuery, hash, file.Path, filename, file.Type, file.Size, file.Executable, file.Target); err != nil {
+				return err
+			}
+		}
+	}
 
-	for _, path := range files {
-		split := strings.Split(path, "/")
-		filename := split[len(split)-1]
-		if _, err := tx.Exec(query, channel, indexDate, id, name, out, hash, version, path, filename); err != nil {
-			fmt.Println(indexDate, id, name, out, hash, version, path, filename)
+	if info != nil {
+		if err := insertOutputInfo(tx, hash, info); err != nil {
 			return err
 		}
 	}
 
+	if err := linkPkg(tx, id, name, out, hash, version, cache, verified); err != nil {
+		return err
+	}
+
 	return tx.Commit()
 }
 
-// rowsToResult converts the rows into a []PkgResult object.
-func rowsToResult(rows *sql.Rows) ([]PkgResult, error) {
-	pkgs := make([]PkgResult, 0)
+// insertOutputInfo stores the narinfo metadata and the references of an output.
+func insertOutputInfo(tx *sql.Tx, hash string, info *OutputInfo) error {
+	const outputQuery = `UPDATE outputs SET nar_hash = $1, nar_size = $2, file_size = $3, deriver = $4, compression = $5, sigs = $6 WHERE output_hash = $7`
+	const referenceQuery = `INSERT OR IGNORE INTO output_references (output_hash, reference_hash, reference) VALUES ($1, $2, $3)`
+
+	if _, err := tx.Exec(outputQuery, info.NarHash, info.NarSize, info.FileSize, info.Deriver, info.Compression, strings.Join(info.Sigs, " "), hash); err != nil {
+		return fmt.Errorf("storing output info: %w", err)
+	}
+
+	for _, reference := range info.References {
+		referenceHash, _, _ := strings.Cut(reference, "-")
+		if _, err := tx.Exec(referenceQuery, hash, referenceHash, reference); err != nil {
+			return fmt.Errorf("storing references: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// StoreOutputInfo stores the narinfo metadata and the references of an output which was stored without them.
+func (db *DB) StoreOutputInfo(hash string, info *OutputInfo) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertOutputInfo(tx, hash, info); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// StoredOutputInfo returns the narinfo metadata of a stored output, nil if the output was stored without it.
+func (db *DB) StoredOutputInfo(hash string) (*OutputInfo, error) {
+	const query = `SELECT nar_hash, nar_size, file_size, deriver, compression, sigs FROM outputs WHERE output_hash = $1`
+
+	info := &OutputInfo{}
+	sigs := ""
+	if err := db.db.QueryRow(query, hash).Scan(&info.NarHash, &info.NarSize, &info.FileSize, &info.Deriver, &info.Compression, &sigs); err != nil {
+		return nil, fmt.Errorf("reading output info: %w", err)
+	}
+
+	if info.NarHash == "" {
+		return nil, nil
+	}
+	info.Sigs = strings.Fields(sigs)
+
+	rows, err := db.db.Query(`SELECT reference FROM output_references WHERE output_hash = $1 ORDER BY reference`, hash)
+	if err != nil {
+		return nil, fmt.Errorf("reading references: %w", err)
+	}
+	defer rows.Close()
+
 	for rows.Next() {
-		result := PkgResult{}
-		if err := rows.Scan(&result.PkgName, &result.Outname, &result.Outhash, &result.Version, &result.Path); err != nil {
-			return nil, err
+		reference := ""
+		if err := rows.Scan(&reference); err != nil {
+			return nil, fmt.Errorf("scanning references: %w", err)
 		}
+		info.References = append(info.References, reference)
+	}
+
+	return info, rows.Err()
+}
+
+// KnownOutputs returns the output hashes which already have their files stored, the value reports if the narinfo metadata is stored too.
+func (db *DB) KnownOutputs() (map[string]bool, error) {
+	rows, err := db.db.Query(`SELECT output_hash, nar_hash != '' FROM outputs`)
+	if err != nil {
+		return nil, fmt.Errorf("listing known outputs: %w", err)
+	}
+	defer rows.Close()
+
+	known := make(map[string]bool)
+	for rows.Next() {
+		hash := ""
+		hasInfo := false
+		if err := rows.Scan(&hash, &hasInfo); err != nil {
+			return nil, fmt.Errorf("scanning known outputs: %w", err)
+		}
+		known[hash] = hasInfo
+	}
+
+	return known, nil
+}
+
+// LinkPkg puts the package information into the index reusing the files of an output which is already stored,
+// the output keeps the cache which originally served it. Returns the number of files of the output.
+func (db *DB) LinkPkg(id, name, out, hash, storeName, version string, verified bool) (int, error) {
+	const query = `SELECT file_count, COALESCE((SELECT cache_url FROM index_outputs WHERE output_hash = $1 AND cache_url != '' LIMIT 1), '')
+	FROM outputs WHERE output_hash = $1`
+
+	count := 0
+	cache := ""
+	if err := db.db.QueryRow(query, hash).Scan(&count, &cache); err != nil {
+		return 0, fmt.Errorf("reading output: %w", err)
+	}
+
+	// Outputs stored before the store names were recorded get them now
+	if _, err := db.db.Exec(`UPDATE outputs SET store_name = $1 WHERE output_hash = $2 AND store_name = ''`, storeName, hash); err != nil {
+		return 0, fmt.Errorf("updating output: %w", err)
+	}
+
+	if err := linkPkg(db.db, id, name, out, hash, version, cache, verified); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// linkPkg adds an output to the index.
+func linkPkg(ex execer, id, name, out, hash, version, cache string, verified bool) error {
+	const query = `INSERT OR IGNORE INTO index_outputs (index_uuid, pkg_name, output_name, output_hash, version, cache_url, verified)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	if _, err := ex.Exec(query, id, name, out, hash, version, cache, verified); err != nil {
+		return fmt.Errorf("linking package: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteIndex removes an index, used to clean up after an unfinished index. The stored outputs are kept for reuse.
+func (db *DB) DeleteIndex(id string) error {
+	if _, err := db.db.Exec(`DELETE FROM index_outputs WHERE index_uuid = $1`, id); err != nil {
+		return fmt.Errorf("deleting index: %w", err)
+	}
+
+	if _, err := db.db.Exec(`DELETE FROM index_failures WHERE index_uuid = $1`, id); err != nil {
+		return fmt.Errorf("deleting index: %w", err)
+	}
 
-		pkgs = append(pkgs, result)
+	if _, err := db.db.Exec(`DELETE FROM indices WHERE index_uuid = $1`, id); err != nil {
+		return fmt.Errorf("deleting index: %w", err)
 	}
 
-	return pkgs, nil
+	return nil
 }
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Limits of the reverse dependency queries.
+const (
+	DefaultRdepsDepth = 5
+	MaxRdepsDepth     = 20
+	RdepsTimeout      = 10 * time.Second
+)
+
+// ReverseDep is an indexed output which references the queried output, directly at depth 1 or through other outputs.
+type ReverseDep struct {
+	PkgName   string `json:"pkg_name"`
+	Outname   string `json:"out_name"`
+	Outhash   string `json:"out_hash"`
+	StorePath string `json:"store_path,omitempty"`
+	Version   string `json:"version"`
+	Depth     int    `json:"depth"` // The length of the shortest reference chain
+}
+
+// rdepsCursor is the position in the reverse dependencies.
+type rdepsCursor struct {
+	Depth   int    `json:"d"`
+	PkgName string `json:"p"`
+	Hash    string `json:"h"`
+}
+
+// ReverseDeps returns a page of the outputs of an index which reference the output hash, following the references of the
+// indexed outputs up to the depth. The results are sorted by the depth and the package name.
+func (db *DB) ReverseDeps(id, hash string, depth int, page PageRequest) (Page[ReverseDep], error) {
+	result := Page[ReverseDep]{Items: make([]ReverseDep, 0)}
+	if page.Sort != "" {
+		return result, ErrBadSort
+	}
+
+	depth = max(1, min(depth, MaxRdepsDepth))
+	ctx, cancel := context.WithTimeout(context.Background(), RdepsTimeout)
+	defer cancel()
+
+	// The traversal only follows the outputs of the index, UNION stops the cycles from growing beyond the depth.
+	// The arguments are added in the order of their first use, sqlite numbers the parameters that way.
+	args := queryArgs{}
+	hashArg := args.add(hash)
+	idArg := args.add(id)
+	with := `WITH RECURSIVE rdeps(output_hash, depth) AS (
+		SELECT ` + hashArg + `, 0
+		UNION
+		SELECT r.output_hash, d.depth + 1 FROM rdeps d
+		JOIN output_references r ON r.reference_hash = d.output_hash
+		JOIN index_outputs io ON io.output_hash = r.output_hash AND io.index_uuid = ` + idArg + `
+		WHERE d.depth < ` + args.add(depth) + `
+	), nearest AS (
+		SELECT output_hash, MIN(depth) AS depth FROM rdeps WHERE output_hash != ` + hashArg + ` GROUP BY output_hash
+	) `
+	from := ` FROM nearest n JOIN index_outputs io ON io.output_hash = n.output_hash AND io.index_uuid = ` + idArg +
+		` JOIN outputs o ON o.output_hash = n.output_hash`
+
+	if err := db.db.QueryRowContext(ctx, with+"SELECT COUNT(*)"+from, args...).Scan(&result.Total); err != nil {
+		if ctx.Err() != nil {
+			return result, ErrQueryTimeout
+		}
+		return result, fmt.Errorf("counting reverse dependencies: %w", err)
+	}
+
+	where := ""
+	if page.Cursor != "" {
+		after := rdepsCursor{}
+		if err := decodeCursor(page.Cursor, &after); err != nil {
+			return result, err
+		}
+		where = fmt.Sprintf(" WHERE (n.depth, io.pkg_name, io.output_hash) > (%s, %s, %s)", args.add(after.Depth), args.add(after.PkgName), args.add(after.Hash))
+	}
+
+	limit := page.limit()
+	query := with + "SELECT io.pkg_name, io.output_name, io.output_hash, o.store_name, io.version, n.depth" + from + where +
+		" ORDER BY n.depth, io.pkg_name, io.output_hash LIMIT " + args.add(limit+1)
+	rows, err := db.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return result, ErrQueryTimeout
+		}
+		return result, fmt.Errorf("reading reverse dependencies: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		dep := ReverseDep{}
+		storeName := ""
+		if err := rows.Scan(&dep.PkgName, &dep.Outname, &dep.Outhash, &storeName, &dep.Version, &dep.Depth); err != nil {
+			return result, fmt.Errorf("scanning reverse dependencies: %w", err)
+		}
+
+		if storeName != "" {
+			dep.StorePath = "/nix/store/" + dep.Outhash + "-" + storeName
+		}
+
+		result.Items = append(result.Items, dep)
+	}
+
+	if err := rows.Err(); err != nil {
+		if ctx.Err() != nil {
+			return result, ErrQueryTimeout
+		}
+		return result, fmt.Errorf("reading reverse dependencies: %w", err)
+	}
+
+	if len(result.Items) > limit {
+		result.Items = result.Items[:limit]
+		last := result.Items[limit-1]
+		result.NextCursor = encodeCursor(rdepsCursor{Depth: last.Depth, PkgName: last.PkgName, Hash: last.Outhash})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"database/sql"
+	"regexp"
+	"sync"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// driverName is the sqlite driver with the REGEXP function registered.
+const driverName = "sqlite3_hund"
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("regexp", regexpMatch, true)
+		},
+	})
+}
+
+// regexpCache keeps the compiled patterns, the function is called once for every row.
+var regexpCache = struct {
+	sync.Mutex
+	patterns map[string]*regexp.Regexp
+}{patterns: make(map[string]*regexp.Regexp)}
+
+// regexpMatch implements `value REGEXP pattern` for sqlite.
+func regexpMatch(pattern, value string) (bool, error) {
+	regexpCache.Lock()
+	re, ok := regexpCache.patterns[pattern]
+	regexpCache.Unlock()
+
+	if !ok {
+		var err error
+		if re, err = regexp.Compile(pattern); err != nil {
+			return false, err
+		}
+
+		regexpCache.Lock()
+		if len(regexpCache.patterns) > 64 {
+			clear(regexpCache.patterns)
+		}
+		regexpCache.patterns[pattern] = re
+		regexpCache.Unlock()
+	}
+
+	return re.MatchString(value), nil
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/charmbracelet/log"
@@ -85,30 +86,100 @@ type HistoryEntry struct {
 	Pkg     PkgResult `json:"pkg"`
 }
 
-// History returns the package search history of the user.
-func (db *DB) History(username string) ([]HistoryEntry, error) {
-	const query = `SELECT index_uuid, date, pkg_name, output_name, output_hash, fullpath, version
-FROM users_history NATURAL JOIN listings WHERE username = $1 ORDER BY date DESC`
-	rows, err := db.db.Query(query, username)
+// historySortColumns maps the sort keys of the history to columns, the history is sorted by the date by default.
+var historySortColumns = map[string]string{
+	SortPkgName: "pkg_name",
+	SortVersion: "version",
+	SortPath:    "fullpath",
+}
+
+// historyCursor is the position in the search history.
+type historyCursor struct {
+	Key   string    `json:"k,omitempty"`
+	Date  time.Time `json:"d"`
+	RowID int64     `json:"r"`
+}
+
+// History returns a page of the package search history of the user, newest first unless sorted by something else.
+func (db *DB) History(username string, page PageRequest) (Page[HistoryEntry], error) {
+	result := Page[HistoryEntry]{Items: make([]HistoryEntry, 0)}
+	const from = "users_history h JOIN index_outputs USING (index_uuid, pkg_name, output_hash) LEFT JOIN files f USING (output_hash, fullpath)"
+
+	sortColumn, byKey := historySortColumns[page.Sort]
+	if !byKey && page.Sort != "" && page.Sort != SortDate {
+		return result, ErrBadSort
+	}
+
+	args := queryArgs{}
+	where := "username = " + args.add(username)
+	if err := db.db.QueryRow("SELECT COUNT(*) FROM "+from+" WHERE "+where, args...).Scan(&result.Total); err != nil {
+		log.Error("Error while counting history", "err", err)
+		return result, err
+	}
+
+	keys, order, cmp := "date DESC, h.rowid DESC", "date", "<"
+	if byKey {
+		keys, order, cmp = sortColumn+", h.rowid", sortColumn, ">"
+	}
+
+	if page.Cursor != "" {
+		after := historyCursor{}
+		if err := decodeCursor(page.Cursor, &after); err != nil {
+			return result, err
+		}
+
+		var position any = after.Date
+		if byKey {
+			position = after.Key
+		}
+		where += fmt.Sprintf(" AND (%s, h.rowid) %s (%s, %s)", order, cmp, args.add(position), args.add(after.RowID))
+	}
+
+	limit := page.limit()
+	query := "SELECT h.rowid, index_uuid, date, pkg_name, output_name, output_hash, fullpath, version, cache_url, verified, " +
+		"COALESCE(f.type, 'regular'), COALESCE(f.size, 0), COALESCE(f.executable, FALSE), COALESCE(f.target, '') FROM " + from +
+		" WHERE " + where + " ORDER BY " + keys + " LIMIT " + args.add(limit+1)
+	rows, err := db.db.Query(query, args...)
 	if err != nil {
 		log.Error("Error while getting history", "err", err)
-		return nil, err
+		return result, err
 	}
 	defer rows.Close()
 
-	history := make([]HistoryEntry, 0)
-	for rows.Next() {
+	last := historyCursor{}
+	for len(result.Items) < limit && rows.Next() {
 		entry := HistoryEntry{}
 		if err := rows.Scan(
-			&entry.IndexID, &entry.Date, &entry.Pkg.PkgName, &entry.Pkg.Outname, &entry.Pkg.Outhash, &entry.Pkg.Path, &entry.Pkg.Version,
+			&last.RowID, &entry.IndexID, &entry.Date, &entry.Pkg.PkgName, &entry.Pkg.Outname, &entry.Pkg.Outhash, &entry.Pkg.Path, &entry.Pkg.Version, &entry.Pkg.Cache, &entry.Pkg.Verified,
+			&entry.Pkg.Type, &entry.Pkg.Size, &entry.Pkg.Executable, &entry.Pkg.Target,
 		); err != nil {
 			log.Error("Error while scanning history", "err", err)
-			return nil, err
+			return result, err
+		}
+		result.Items = append(result.Items, entry)
+	}
+
+	more := len(result.Items) == limit && rows.Next()
+	if err := rows.Err(); err != nil {
+		log.Error("Error while getting history", "err", err)
+		return result, err
+	}
+
+	if more {
+		entry := result.Items[len(result.Items)-1]
+		last.Date = entry.Date
+		switch page.Sort {
+		case SortPkgName:
+			last.Key = entry.Pkg.PkgName
+		case SortVersion:
+			last.Key = entry.Pkg.Version
+		case SortPath:
+			last.Key = entry.Pkg.Path
 		}
-		history = append(history, entry)
+		result.NextCursor = encodeCursor(last)
 	}
 
-	return history, nil
+	return result, nil
 }
 
 // HistoryAdd adds a history entry for a user.
@@ -21,15 +21,10 @@
           pname = "nix-hund";
           version = "0.2";
 
-          src = pkgs.fetchFromGitHub
-            {
-              owner = "TypicalAM";
-              repo = "nix-hund";
-              rev = "v${version}";
-              hash = "sha256-9n/WH6Nodx3uewjtdYWWCW6Kt5uYNttm7NN599nVpmo=";
-            } + "/backend";
+          src = ./.;
 
-          vendorHash = "sha256-v4Y6CUxTz59GX7GI8zfI7RsC24/aS0aHW6s6nQzRBkA=";
+          vendorHash = "sha256-97tCY207rcXN8QSFIDpF5t5vlwc4n7lbCg814uZoVZs=";
+          tags = [ "sqlite_fts5" ];
 
           meta = {
             description = "Locate nix development files easily";
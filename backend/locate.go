@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/TypicalAM/nix-hund/db"
+)
+
+// locateOptions are the flags of the locate subcommand, they mirror the ones of nix-locate.
+type locateOptions struct {
+	server    string
+	token     string
+	channel   string
+	system    string
+	index     string
+	wholeName bool
+	atRoot    bool
+	regex     bool
+}
+
+// locate runs the `nix-hund locate <pattern>` subcommand which prints the matching files in the nix-locate format.
+func locate(args []string) error {
+	opts := locateOptions{}
+	fs := flag.NewFlagSet("locate", flag.ExitOnError)
+	fs.StringVar(&opts.server, "server", "", "URL of a nix-hund server to query instead of the local database, for example https://hund.example.com")
+	fs.StringVar(&opts.token, "token", os.Getenv("HUND_TOKEN"), "Token used for the server, defaults to $HUND_TOKEN")
+	fs.StringVar(&opts.channel, "channel", "", "Channel whose newest index should be queried")
+	fs.StringVar(&opts.system, "system", "", "Only use the indices made for this system with --channel, for example aarch64-linux")
+	fs.StringVar(&opts.index, "index", "", "ID of the index to query, takes precedence over --channel")
+	fs.BoolVar(&opts.wholeName, "whole-name", false, "Only match files whose basename matches the pattern exactly")
+	fs.BoolVar(&opts.atRoot, "at-root", false, "Treat the pattern as an absolute path which has to match from the root of the output")
+	fs.BoolVar(&opts.regex, "regex", false, "Treat the pattern as a regular expression instead of literal text")
+	fs.BoolVar(&opts.regex, "r", false, "Shorthand for --regex")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: nix-hund locate [flags] <pattern>")
+		fs.PrintDefaults()
+	}
+
+	// Allow the flags to come after the pattern, like in nix-locate
+	patterns := make([]string, 0)
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			break
+		}
+		patterns = append(patterns, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	if len(patterns) != 1 {
+		fs.Usage()
+		return errors.New("expected exactly one pattern")
+	}
+
+	if opts.index == "" && opts.channel == "" {
+		return errors.New("specify the index using --index or --channel")
+	}
+
+	mode, query, err := locatePattern(patterns[0], opts)
+	if err != nil {
+		return err
+	}
+
+	var source locateSource
+	if opts.server != "" {
+		source = &remoteSource{server: strings.TrimSuffix(opts.server, "/"), token: opts.token, cli: http.DefaultClient}
+	} else {
+		database, err := db.New(*cacheDir)
+		if err != nil {
+			return err
+		}
+		source = &localSource{dbase: database}
+	}
+
+	id := opts.index
+	if id == "" {
+		if id, err = source.latestIndex(opts.channel, opts.system); err != nil {
+			return err
+		}
+	}
+
+	// The regex results are capped, so they are collected first to avoid printing a partial list
+	results := make([]db.PkgResult, 0)
+	page := db.PageRequest{Limit: db.MaxPageSize, Sort: db.SortPkgName}
+	for {
+		res, err := source.query(id, query, mode, page)
+		if err != nil {
+			return err
+		}
+
+		if mode == db.ModeRegex && res.Total >= db.MaxRegexResults {
+			return fmt.Errorf("the pattern matches at least %d files, make it more specific", db.MaxRegexResults)
+		}
+
+		for _, pkg := range res.Items {
+			if mode == db.ModeRegex {
+				results = append(results, pkg)
+			} else {
+				printLocateResult(pkg)
+			}
+		}
+
+		if res.NextCursor == "" {
+			break
+		}
+		page.Cursor = res.NextCursor
+	}
+
+	for _, pkg := range results {
+		printLocateResult(pkg)
+	}
+
+	return nil
+}
+
+// locatePattern translates the pattern and the nix-locate flags into a query mode supported by the index. Only the
+// regular expressions use the regex mode, the other patterns are exact or glob queries narrowed by the trigram index.
+func locatePattern(pattern string, opts locateOptions) (db.QueryMode, string, error) {
+	if opts.regex {
+		return locateRegex(pattern, opts)
+	}
+
+	path := db.EscapeGlob(strings.TrimPrefix(pattern, "/"))
+	switch {
+	case opts.atRoot && opts.wholeName:
+		return db.ModeGlob, "/" + path, nil
+	case opts.atRoot:
+		return db.ModeGlob, "/" + path + "*", nil
+	case opts.wholeName && !strings.Contains(pattern, "/"):
+		return db.ModeExact, pattern, nil
+	case opts.wholeName:
+		return db.ModeGlob, "*/" + path, nil
+	}
+
+	return db.ModeSubstring, pattern, nil
+}
+
+// locateRegex anchors the regular expression according to the flags.
+func locateRegex(pattern string, opts locateOptions) (db.QueryMode, string, error) {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return "", "", fmt.Errorf("invalid pattern: %w", err)
+	}
+
+	if opts.atRoot {
+		pattern = "^/(?:" + strings.TrimPrefix(pattern, "/") + ")"
+	}
+
+	if opts.wholeName {
+		if !opts.atRoot {
+			pattern = "(?:^|/)(?:" + pattern + ")"
+		}
+		pattern += "$"
+	}
+
+	return db.ModeRegex, pattern, nil
+}
+
+// printLocateResult prints a file in the `attr.output size type path` format of nix-locate.
+func printLocateResult(pkg db.PkgResult) {
+	attr := pkg.PkgName + "." + pkg.Outname
+	storePath := pkg.StorePath
+	if storePath == "" {
+		storePath = "/nix/store/" + pkg.Outhash
+	}
+
+	filetype := "r"
+	switch {
+	case pkg.Type == "symlink":
+		filetype = "s"
+	case pkg.Executable:
+		filetype = "x"
+	}
+
+	fmt.Printf("%-40s %14s %s %s%s\n", attr, formatSize(pkg.Size), filetype, storePath, pkg.Path)
+}
+
+// formatSize formats a size with thousands separators.
+func formatSize(size int64) string {
+	digits := fmt.Sprint(size)
+	var b strings.Builder
+	for i, digit := range digits {
+		if i != 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(digit)
+	}
+
+	return b.String()
+}
+
+// locateSource is where the locate subcommand gets its results from.
+type locateSource interface {
+	latestIndex(channel, system string) (string, error)
+	query(id, query string, mode db.QueryMode, page db.PageRequest) (db.Page[db.PkgResult], error)
+}
+
+// localSource queries the local index database directly.
+type localSource struct {
+	dbase *db.DB
+}
+
+// latestIndex returns the newest index of the channel, an empty system matches every system.
+func (src *localSource) latestIndex(channel, system string) (string, error) {
+	indices, err := src.dbase.ListIndices(channel, system, db.PageRequest{Limit: 1})
+	if err != nil {
+		return "", err
+	}
+
+	if len(indices.Items) == 0 {
+		return "", fmt.Errorf("no indices for channel %s", channel)
+	}
+
+	return indices.Items[0].ID, nil
+}
+
+// query queries the index.
+func (src *localSource) query(id, query string, mode db.QueryMode, page db.PageRequest) (db.Page[db.PkgResult], error) {
+	return src.dbase.QueryPkg(id, query, mode, page)
+}
+
+// remoteSource queries a nix-hund server.
+type remoteSource struct {
+	server string
+	token  string
+	cli    *http.Client
+}
+
+// latestIndex returns the newest index of the channel, an empty system matches every system.
+func (src *remoteSource) latestIndex(channel, system string) (string, error) {
+	indices := db.Page[db.IndexInfo]{}
+	params := url.Values{"channel": {channel}, "limit": {"1"}}
+	if system != "" {
+		params.Set("system", system)
+	}
+	if err := src.get("/pkg/channel/index?"+params.Encode(), &indices); err != nil {
+		return "", err
+	}
+
+	if len(indices.Items) == 0 {
+		return "", fmt.Errorf("no indices for channel %s", channel)
+	}
+
+	return indices.Items[0].ID, nil
+}
+
+// query queries the index.
+func (src *remoteSource) query(id, query string, mode db.QueryMode, page db.PageRequest) (db.Page[db.PkgResult], error) {
+	res := db.Page[db.PkgResult]{}
+	params := url.Values{
+		"query": {query},
+		"mode":  {string(mode)},
+		"limit": {fmt.Sprint(page.Limit)},
+		"sort":  {page.Sort},
+	}
+	if page.Cursor != "" {
+		params.Set("cursor", page.Cursor)
+	}
+
+	err := src.get("/pkg/index/"+url.PathEscape(id)+"/query?"+params.Encode(), &res)
+	return res, err
+}
+
+// get fetches a JSON document from the server.
+func (src *remoteSource) get(path string, v any) error {
+	req, err := http.NewRequest(http.MethodGet, src.server+path, nil)
+	if err != nil {
+		return err
+	}
+
+	if src.token != "" {
+		req.Header.Set("Authorization", "Bearer "+src.token)
+	}
+
+	resp, err := src.cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg := struct {
+			Message string `json:"message"`
+		}{}
+		json.NewDecoder(resp.Body).Decode(&msg)
+		return fmt.Errorf("server responded with %s: %s", resp.Status, msg.Message)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
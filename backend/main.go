@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 
 	"github.com/TypicalAM/nix-hund/db"
@@ -17,21 +18,41 @@ import (
 )
 
 var disableMetrics = flag.Bool("metrics", true, "Show metrics")
-var fetchChannel = flag.String("fetch", "", "Channel name for fetching data, something that can be put in `nix-env --file`. For example `channel:nixos-21.11` or a nixpkgs archive url, should be paired with --out_path")
+var fetchChannel = flag.String("fetch", "", "Channel name for fetching data, something that can be put in `nix-env --file`. For example `channel:nixos-21.11` or a nixpkgs archive url. A packages.json or packages.json.br file or url is read directly without nix-env, should be paired with --out_path")
+var system = flag.String("system", nixpkgs.DefaultSystem, "System of the packages fetched with --fetch, for example aarch64-linux or x86_64-darwin")
 var outpath = flag.String("out_path", "", "Output path for a dumped channel. ~/.cache/nix-hund/channels/file.json is appropriate for reading by the program")
 var cacheDir = flag.String("cache_dir", "", "Cache directory to use instead of the default one")
+var migrateOnly = flag.Bool("migrate-only", false, "Apply the pending database migrations and exit")
+var migrateDryRun = flag.Bool("migrate-dry-run", false, "Print the pending database migrations without applying them and exit")
+var substituters = flag.String("substituters", CACHE_URL, "Space or comma separated binary cache URLs used to fetch the listings, tried in order. Can be empty when --local_store is used")
+var localStore = flag.String("local_store", "", "Read the listings of the store paths present in a local nix store before trying the substituters, for example /nix/store")
+var narFallback = flag.Bool("nar_fallback", false, "Download and parse the NAR of a store path when no source publishes its .ls listing, a lot slower than the listings")
+var trustedKeys = flag.String("trusted_public_keys", nixpkgs.DefaultTrustedKeys, "Space or comma separated name:key ed25519 keys trusted to sign the narinfo files")
+var refreshChannels = flag.String("refresh", "", "Whitespace separated channels which are fetched again on the --refresh_schedule, as name=source or name@system=source. The source is anything accepted by --fetch")
+var refreshSchedule = flag.String("refresh_schedule", "@daily", "Cron schedule of the channel refresh, for example `0 4 * * *`")
+var refreshIndex = flag.Bool("refresh_index", false, "Index a refreshed channel again when its content changed, using the settings of its newest index")
+var watchChannels = flag.Bool("watch_channels", true, "Reload the channel list when the files in the channels directory change")
+var fetchWorkers = flag.Int("fetch_workers", nixpkgs.DefaultWorkers, "Maximum number of concurrent listing downloads while generating an index")
 
 const CACHE_URL = "http://cache.nixos.org"
 
 func main() {
 	flag.Parse()
 
+	if flag.Arg(0) == "locate" {
+		if err := locate(flag.Args()[1:]); err != nil {
+			log.Fatal("Locating failed", "err", err)
+		}
+
+		return
+	}
+
 	if *fetchChannel != "" {
 		if *outpath == "" {
 			log.Fatal("Specified the fetch channel without an out_path, use --out_path to tell nix-hund where to put the result of the fetch")
 		}
 
-		if err := nixpkgs.FetchChannel(*fetchChannel, *outpath); err != nil {
+		if err := nixpkgs.FetchChannel(*fetchChannel, *system, *outpath); err != nil {
 			log.Fatal("Cannot fetch the data for a channel", "err", err)
 		}
 
@@ -68,21 +89,107 @@ func main() {
 		log.Fatal("Cache directoy exists and isn't a directory", "dir", dir)
 	}
 
+	if *migrateDryRun {
+		database, err := db.Open(*cacheDir)
+		if err != nil {
+			log.Fatal("Loading db failed", "err", err)
+		}
+
+		pending, err := database.PendingMigrations()
+		if err != nil {
+			log.Fatal("Checking migrations failed", "err", err)
+		}
+
+		for _, m := range pending {
+			fmt.Printf("%d\t%s\n", m.Version, m.Description)
+		}
+
+		log.Info("Pending migrations", "count", len(pending))
+		return
+	}
+
 	database, err := db.New(*cacheDir)
 	if err != nil {
 		log.Fatal("Loading db failed", "err", err)
 	}
 
+	if *migrateOnly {
+		version, err := database.SchemaVersion()
+		if err != nil {
+			log.Fatal("Checking the schema version failed", "err", err)
+		}
+
+		pending, err := database.PendingMigrations()
+		if err != nil {
+			log.Fatal("Checking migrations failed", "err", err)
+		}
+
+		if len(pending) != 0 {
+			for _, m := range pending {
+				log.Warn("Migration is still pending", "version", m.Version, "description", m.Description)
+			}
+
+			log.Warn("Database is not up to date", "version", version, "pending", len(pending))
+			return
+		}
+
+		log.Info("Database is up to date", "version", version)
+		return
+	}
+
 	channels, err := nixpkgs.AvailableChannels(*cacheDir)
 	if err != nil {
 		log.Fatal("Couldn't get the available channels", "err", err)
 	}
 
-	cntr, err := routes.New(CACHE_URL, database, channels, *cacheDir)
+	if *fetchWorkers < 1 {
+		log.Fatal("The number of fetch workers has to be positive", "fetch_workers", *fetchWorkers)
+	}
+
+	caches, err := nixpkgs.ParseSubstituters(*substituters)
+	if err != nil {
+		log.Fatal("Invalid substituters", "err", err)
+	}
+
+	sources := nixpkgs.Sources{}
+	if *localStore != "" {
+		sources = append(sources, &nixpkgs.LocalStore{Dir: *localStore})
+	}
+	for _, cache := range caches {
+		sources = append(sources, nixpkgs.NewBinaryCache(cache, *narFallback))
+	}
+
+	if len(sources) == 0 {
+		log.Fatal("No listing sources, specify --substituters or --local_store")
+	}
+
+	keys, err := nixpkgs.ParsePublicKeys(*trustedKeys)
+	if err != nil {
+		log.Fatal("Invalid trusted public keys", "err", err)
+	}
+
+	refresh, err := nixpkgs.ParseChannelSources(*refreshChannels)
+	if err != nil {
+		log.Fatal("Invalid refreshed channels", "err", err)
+	}
+
+	cntr, err := routes.New(sources, keys, database, channels, *cacheDir, *fetchWorkers)
 	if err != nil {
 		log.Fatal("Creating controller failed", "err", err)
 	}
 
+	if *watchChannels {
+		if err := cntr.WatchChannels(); err != nil {
+			log.Fatal("Watching the channels failed", "err", err)
+		}
+	}
+
+	if len(refresh) != 0 {
+		if err := cntr.StartRefresh(*refreshSchedule, refresh, *refreshIndex); err != nil {
+			log.Fatal("Starting the channel refresh failed", "err", err)
+		}
+	}
+
 	e := echo.New()
 	e.Use(middleware.Recover())
 	e.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
@@ -111,6 +218,11 @@ func main() {
 	pkgs.GET("/channel/index", cntr.IndexList)
 	pkgs.POST("/channel/index/generate", cntr.IndexGenerate, protected)
 	pkgs.GET("/index/:id/query", cntr.IndexQuery, protected)
+	pkgs.GET("/index/:id/failures", cntr.IndexFailures, protected)
+	pkgs.POST("/index/:id/retry", cntr.IndexRetry, protected)
+	pkgs.GET("/index/:id/rdeps", cntr.IndexReverseDeps, protected)
+	pkgs.GET("/index/jobs/:id", cntr.IndexJob, protected)
+	pkgs.DELETE("/index/jobs/:id", cntr.IndexJobCancel, protected)
 
 	if *disableMetrics {
 		e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
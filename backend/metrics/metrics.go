@@ -30,12 +30,24 @@ var (
 		Namespace: "hund",
 	})
 
-	NixpkgsDate = promauto.NewGauge(prometheus.GaugeOpts{
-		Name:      "nixpkgs_date",
-		Help:      "The date of the currently used nixpkgs",
+	FailedOutputsCount = promauto.NewCounter(prometheus.CounterOpts{
+		Name:      "failed_outputs",
+		Help:      "The number of outputs whose listing couldn't be fetched",
 		Namespace: "hund",
 	})
 
+	NixpkgsDate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "nixpkgs_date",
+		Help:      "The date of the nixpkgs of every available channel as a unix timestamp",
+		Namespace: "hund",
+	}, []string{"channel", "system", "revision"})
+
+	ChannelPackageCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name:      "channel_pkgs",
+		Help:      "The number of packages in every available channel",
+		Namespace: "hund",
+	}, []string{"channel", "system"})
+
 	LoginAttempts = promauto.NewCounter(prometheus.CounterOpts{
 		Name:      "login_attempts",
 		Help:      "The total number of login attempts",
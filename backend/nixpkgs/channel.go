@@ -2,28 +2,119 @@ package nixpkgs
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/charmbracelet/log"
 )
 
-// AvailableChannels returns the available channels.
-func AvailableChannels(cacheDir string) ([]string, error) {
+// DefaultSystem is the system of the fetched packages, channels without metadata were fetched for it.
+const DefaultSystem = "x86_64-linux"
+
+// metaSuffix is the suffix of the metadata file stored next to the channel file.
+const metaSuffix = ".meta.json"
+
+// Channel is a fetched channel, the name is the name of the channel file. The nixpkgs version, revision and date are only
+// known if the source provides them.
+type Channel struct {
+	Name        string    `json:"name"`
+	System      string    `json:"system"`
+	Source      string    `json:"source,omitempty"`  // What was passed to --fetch
+	Version     string    `json:"version,omitempty"` // For example 24.05.1503.752c634c09ce
+	Revision    string    `json:"revision,omitempty"`
+	NixpkgsDate time.Time `json:"nixpkgs_date,omitzero"`
+	Evaluated   time.Time `json:"evaluated,omitzero"` // When the channel was fetched
+	Packages    int       `json:"packages"`
+}
+
+// ChannelSource is where a channel is fetched from, the source is anything accepted by FetchChannel.
+type ChannelSource struct {
+	Name   string
+	Source string
+	System string
+}
+
+// ParseChannelSources parses a whitespace separated list of `name=source` or `name@system=source` channels, for example
+// nixos-24.05@aarch64-linux=https://channels.nixos.org/nixos-24.05/packages.json.br. The system defaults to DefaultSystem.
+func ParseChannelSources(value string) ([]ChannelSource, error) {
+	fields := strings.Fields(value)
+	result := make([]ChannelSource, 0, len(fields))
+	for _, field := range fields {
+		name, source, ok := strings.Cut(field, "=")
+		if !ok || source == "" {
+			return nil, fmt.Errorf("invalid channel %q: expected name=source", field)
+		}
+
+		name, system, ok := strings.Cut(name, "@")
+		if !ok {
+			system = DefaultSystem
+		}
+
+		if name == "" || system == "" || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+			return nil, fmt.Errorf("invalid channel %q: expected a file name and a system", field)
+		}
+
+		result = append(result, ChannelSource{Name: name, Source: source, System: system})
+	}
+
+	return result, nil
+}
+
+// MetaPath returns the path of the metadata file for a channel file, for example nixos-24.05.meta.json for nixos-24.05.json.
+func MetaPath(outpath string) string {
+	return strings.TrimSuffix(outpath, ".json") + metaSuffix
+}
+
+// ChannelsDir returns the directory with the channel files, the user cache directory is used if the cache directory is empty.
+func ChannelsDir(cacheDir string) (string, error) {
 	cache := cacheDir
 	if cache == "" {
 		userCache, err := os.UserCacheDir()
 		if err != nil {
-			return nil, err
+			return "", err
 		}
 		cache = userCache
 	}
 
-	dir := cache + "/nix-hund/channels"
+	return cache + "/nix-hund/channels", nil
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// validChannel is a channel file which was already validated.
+type validChannel struct {
+	stamp    fileStamp
+	packages int
+}
+
+// validChannels keeps the channel files which were already validated, so that the unchanged files aren't read again.
+var validChannels = struct {
+	sync.Mutex
+	files map[string]validChannel
+}{files: make(map[string]validChannel)}
+
+// AvailableChannels returns the available channels. Corrupt or partially written channel files are skipped with a warning.
+func AvailableChannels(cacheDir string) ([]Channel, error) {
+	dir, err := ChannelsDir(cacheDir)
+	if err != nil {
+		return nil, err
+	}
+
 	d, err := os.Open(dir)
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -50,19 +141,104 @@ func AvailableChannels(cacheDir string) ([]string, error) {
 		return nil, err
 	}
 
+	validChannels.Lock()
+	defer validChannels.Unlock()
 
-	result := make([]string, 0)
+	valid := make(map[string]validChannel)
+	result := make([]Channel, 0)
 	for _, file := range files {
-		if file.Mode().IsRegular() && strings.HasSuffix(file.Name(), ".json") {
-			result = append(result, file.Name()[:len(file.Name())-5])
+		if !file.Mode().IsRegular() || !strings.HasSuffix(file.Name(), ".json") || strings.HasSuffix(file.Name(), metaSuffix) {
+			continue
 		}
+
+		path := filepath.Join(dir, file.Name())
+		checked := validChannels.files[path]
+		if stamp := (fileStamp{size: file.Size(), modTime: file.ModTime()}); checked.stamp != stamp {
+			packages, err := ValidateChannel(path)
+			if err != nil {
+				log.Warn("Skipping a corrupt channel file", "path", path, "err", err)
+				continue
+			}
+			checked = validChannel{stamp: stamp, packages: packages}
+		}
+
+		valid[path] = checked
+		result = append(result, readChannel(path, checked.packages))
 	}
 
+	validChannels.files = valid
 	return result, nil
 }
 
-// FetchChannel fetches the data for a specific channel. The channel should be something you can put in `nix-env --file`.
-func FetchChannel(channel, outpath string) error {
+// ValidateChannel checks that a channel file is a complete package list, one package at a time. Returns the number of packages.
+func ValidateChannel(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	tok, err := dec.Token()
+	if err != nil {
+		return 0, err
+	}
+
+	if tok != json.Delim('{') {
+		return 0, errors.New("expected an object")
+	}
+
+	count := 0
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return 0, err
+		}
+
+		pkg := info{}
+		if err := dec.Decode(&pkg); err != nil {
+			return 0, fmt.Errorf("package %v: %w", tok, err)
+		}
+		count++
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return 0, err
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return 0, errors.New("unexpected data after the package list")
+	}
+
+	return count, nil
+}
+
+// readChannel reads the metadata of a channel file, a missing or broken metadata file means the default system.
+// The package count comes from the validation of the channel file.
+func readChannel(path string, packages int) Channel {
+	channel := Channel{}
+	data, err := os.ReadFile(MetaPath(path))
+	if err == nil {
+		err = json.Unmarshal(data, &channel)
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn("Couldn't read the channel metadata", "path", MetaPath(path), "err", err)
+	}
+
+	channel.Name = strings.TrimSuffix(filepath.Base(path), ".json")
+	channel.Packages = packages
+	if channel.System == "" {
+		channel.System = DefaultSystem
+	}
+
+	return channel
+}
+
+// FetchChannel fetches the data for a specific channel and system, for example aarch64-linux. The channel should be something you
+// can put in `nix-env --file`, or a prebuilt packages.json(.br) file or URL which is read without evaluating nixpkgs.
+// The system is recorded in a metadata file next to the output.
+func FetchChannel(channel, system, outpath string) error {
 	if _, err := os.Stat(outpath); err == nil {
 		log.Error("File already exists", "name", outpath)
 		return errors.New("already exists")
@@ -70,10 +246,162 @@ func FetchChannel(channel, outpath string) error {
 
 	log.Info("Fetching channel data, this could take a while")
 
+	// The channel is written to a temporary file, a partial or empty channel file would be loaded as a channel
+	tmp, err := tempChannelFile(outpath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // Does nothing after the rename
+
+	meta, err := fetchChannel(channel, system, tmp)
+	if err != nil {
+		return err
+	}
+
+	if err := installChannel(tmp, outpath, meta); err != nil {
+		return err
+	}
+
+	log.Info("Fetching done", "pkgs", meta.Packages, "system", system, "version", meta.Version)
+	return nil
+}
+
+// RefreshChannel fetches the channel again into a temporary file and replaces the channel file if its content changed, so that
+// the readers never see a partially written channel. Returns the sha256 hash of the content and whether it changed.
+func RefreshChannel(channel, system, outpath string) (string, bool, error) {
+	tmp, err := tempChannelFile(outpath)
+	if err != nil {
+		return "", false, err
+	}
+	defer os.Remove(tmp) // Does nothing after the rename
+
+	meta, err := fetchChannel(channel, system, tmp)
+	if err != nil {
+		return "", false, err
+	}
+
+	oldHash, err := fileHash(outpath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", false, err
+	}
+
+	newHash, err := fileHash(tmp)
+	if err != nil {
+		return "", false, err
+	}
+
+	if oldHash == newHash {
+		return newHash, false, nil
+	}
+
+	if err := installChannel(tmp, outpath, meta); err != nil {
+		return "", false, err
+	}
+
+	log.Info("Refreshed channel", "path", outpath, "pkgs", meta.Packages, "system", system, "version", meta.Version, "hash", newHash)
+	return newHash, true, nil
+}
+
+// tempChannelFile creates an empty temporary file next to the channel file, its name doesn't end with .json so it isn't loaded
+// as a channel.
+func tempChannelFile(outpath string) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(outpath), "."+filepath.Base(outpath)+"-*.tmp")
+	if err != nil {
+		return "", err
+	}
+
+	return tmp.Name(), tmp.Close()
+}
+
+// installChannel renames the fetched temporary file to the channel file. The metadata goes first, so that a new channel is never
+// read without its system.
+func installChannel(tmp, outpath string, meta Channel) error {
+	if err := writeMeta(outpath, meta); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, outpath)
+}
+
+// fetchChannel writes the packages of the channel to the output path, returns the metadata of the channel.
+func fetchChannel(channel, system, outpath string) (Channel, error) {
+	meta := Channel{}
+	var err error
+	if IsPackagesJSON(channel) {
+		meta, err = writePackagesJSON(channel, system, outpath)
+	} else {
+		meta, err = evalChannel(channel, system, outpath)
+	}
+	if err != nil {
+		return meta, err
+	}
+
+	// An empty channel would replace a working one on the next refresh
+	if meta.Packages == 0 {
+		return meta, fmt.Errorf("%w: %s has no packages for %s", ErrNoPackages, channel, system)
+	}
+
+	meta.System = system
+	meta.Source = channel
+	meta.Evaluated = time.Now().UTC()
+	return meta, nil
+}
+
+// writePackagesJSON converts a packages.json to the channel file.
+func writePackagesJSON(channel, system, outpath string) (Channel, error) {
 	outfile, err := os.Create(outpath)
 	if err != nil {
+		return Channel{}, err
+	}
+	defer outfile.Close()
+
+	meta, err := ConvertPackagesJSON(channel, system, outfile)
+	if err != nil {
+		return meta, err
+	}
+
+	return meta, outfile.Close()
+}
+
+// writeMeta atomically writes the metadata file of a channel file.
+func writeMeta(outpath string, channel Channel) error {
+	channel.Name = strings.TrimSuffix(filepath.Base(outpath), ".json")
+	meta, err := json.Marshal(channel)
+	if err != nil {
+		return err
+	}
+
+	tmp := MetaPath(outpath) + ".tmp"
+	if err := os.WriteFile(tmp, meta, 0644); err != nil {
 		return err
 	}
+
+	return os.Rename(tmp, MetaPath(outpath))
+}
+
+// fileHash returns the hex encoded sha256 hash of a file.
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// evalChannel dumps the packages of the channel using nix-env, returns the number of packages and the nixpkgs version.
+func evalChannel(channel, system, outpath string) (Channel, error) {
+	meta := Channel{}
+	outfile, err := os.Create(outpath)
+	if err != nil {
+		return meta, err
+	}
 	defer outfile.Close()
 
 	buf := &bytes.Buffer{}
@@ -85,21 +413,111 @@ func FetchChannel(channel, outpath string) error {
 		"--available",
 		"--json",
 		"--arg", "config", "{ allowAliases = false; }",
-		"--argstr", "system", "x86_64-linux",
+		"--argstr", "system", system,
 		"--prebuilt-only",
 		"--show-trace",
 	)
 	cmd.Stdout = io.MultiWriter(outfile, buf)
 
 	if err := cmd.Run(); err != nil {
-		return err
+		return meta, err
 	}
 
 	result := list{}
 	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
-		return err
+		return meta, err
 	}
+	meta.Packages = len(result)
 
-	log.Info("Fetching done", "pkgs", len(result))
-	return nil
+	// The version and the date are only informational, the channel is usable without them
+	out, err := exec.Command("nix-instantiate", "--eval", "--json", "--attr", "lib.version", channel).Output()
+	if err == nil {
+		err = json.Unmarshal(out, &meta.Version)
+	}
+
+	if err != nil {
+		log.Warn("Couldn't read the nixpkgs version", "channel", channel, "err", err)
+	} else {
+		meta.Revision, meta.NixpkgsDate = parseVersion(meta.Version)
+	}
+
+	// Only the flake versions contain the date
+	if meta.NixpkgsDate.IsZero() {
+		if meta.NixpkgsDate, err = channelDate(channel); err != nil {
+			log.Warn("Couldn't find the nixpkgs date, the channel has no nixpkgs_date metric", "channel", channel, "err", err)
+		}
+	}
+
+	return meta, nil
+}
+
+// channelDate finds the date of an evaluated nixpkgs whose version doesn't contain it. The date is the commit date from
+// lib.trivial.lastModifiedDate if nixpkgs has it, otherwise the publishing date of the channel tarball.
+func channelDate(channel string) (time.Time, error) {
+	out, err := exec.Command("nix-instantiate", "--eval", "--json", "--attr", "lib.trivial.lastModifiedDate", channel).Output()
+	if err == nil {
+		lastModified := ""
+		if err := json.Unmarshal(out, &lastModified); err == nil {
+			if date, err := time.Parse("20060102150405", lastModified); err == nil {
+				return date, nil
+			}
+		}
+	}
+
+	url := channelTarballURL(channel)
+	if url == "" {
+		return time.Time{}, errors.New("no lastModifiedDate in lib.trivial and the channel isn't downloaded")
+	}
+
+	resp, err := channelClient.Head(url)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("unexpected response while checking %s: %s", url, resp.Status)
+	}
+
+	modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("no publishing date for %s: %w", url, err)
+	}
+
+	return modified.UTC(), nil
+}
+
+// channelTarballURL returns the URL nix downloads the channel from, for example channel:nixos-24.05 is downloaded from
+// https://channels.nixos.org/nixos-24.05/nixexprs.tar.xz. Local channels return an empty string.
+func channelTarballURL(channel string) string {
+	if name, ok := strings.CutPrefix(channel, "channel:"); ok {
+		return "https://channels.nixos.org/" + name + "/nixexprs.tar.xz"
+	}
+
+	if strings.HasPrefix(channel, "http://") || strings.HasPrefix(channel, "https://") {
+		return channel
+	}
+
+	return ""
+}
+
+// parseVersion reads the revision and the date from a nixpkgs version. The channels use <release>.<revcount>.<short rev>,
+// for example 24.05.1503.752c634c09ce, or <release>pre<revcount>.<short rev>, the flakes use <release>.<yyyymmdd>.<short rev>.
+func parseVersion(version string) (string, time.Time) {
+	parts := strings.Split(version, ".")
+	if len(parts) < 3 {
+		return "", time.Time{}
+	}
+
+	revision := parts[len(parts)-1]
+	if len(revision) < 7 || strings.Trim(revision, "0123456789abcdef") != "" {
+		return "", time.Time{}
+	}
+
+	date, err := time.Parse("20060102", parts[len(parts)-2])
+	if err != nil {
+		return revision, time.Time{}
+	}
+
+	return revision, date
 }
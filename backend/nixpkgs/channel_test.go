@@ -0,0 +1,86 @@
+package nixpkgs
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseVersion(t *testing.T) {
+	for version, want := range map[string]struct {
+		revision string
+		date     time.Time
+	}{
+		"24.05.1503.752c634c09ce":     {revision: "752c634c09ce"},
+		"24.11pre681234.3c1f8a9b0d2e": {revision: "3c1f8a9b0d2e"},
+		"24.05.20240601.752c634":      {revision: "752c634", date: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		"24.05":                       {},
+		"24.05.1503.not-a-revision":   {},
+		"":                            {},
+	} {
+		revision, date := parseVersion(version)
+		if revision != want.revision || !date.Equal(want.date) {
+			t.Errorf("%q: got %q and %v, want %q and %v", version, revision, date, want.revision, want.date)
+		}
+	}
+}
+
+func TestChannelTarballURL(t *testing.T) {
+	for channel, want := range map[string]string{
+		"channel:nixos-24.05": "https://channels.nixos.org/nixos-24.05/nixexprs.tar.xz",
+		"https://github.com/NixOS/nixpkgs/archive/752c634c09ce.tar.gz": "https://github.com/NixOS/nixpkgs/archive/752c634c09ce.tar.gz",
+		"/nix/var/nix/profiles/per-user/root/channels/nixos":           "",
+		"<nixpkgs>": "",
+	} {
+		if got := channelTarballURL(channel); got != want {
+			t.Errorf("%q: got %q, want %q", channel, got, want)
+		}
+	}
+}
+
+func TestFetchChannel(t *testing.T) {
+	release := writeRelease(t, `{"hello": {"system": "aarch64-linux", "outputs": {"out": "/nix/store/qzh70f91a8sc1kb0n9hbf52hcv3jgy68-hello-2.12"}}}`)
+	cacheDir := t.TempDir()
+	dir, err := ChannelsDir(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := FetchChannel(release, "aarch64-linux", filepath.Join(dir, "nixos-24.05.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := FetchChannel(release, "x86_64-linux", filepath.Join(dir, "empty.json")); err == nil {
+		t.Error("expected an error for a channel without packages")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+
+	// Neither the temporary files nor the failed channel are left behind
+	if want := []string{"nixos-24.05.json", "nixos-24.05.meta.json"}; !slices.Equal(names, want) {
+		t.Errorf("got the files %v, want %v", names, want)
+	}
+
+	channels, err := AvailableChannels(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(channels) != 1 || channels[0].System != "aarch64-linux" {
+		t.Errorf("got %+v, want the channel for aarch64-linux", channels)
+	}
+}
@@ -0,0 +1,203 @@
+package nixpkgs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrMalformedListing = errors.New("malformed listing")
+
+// File is a regular file or a symlink from a listing.
+type File struct {
+	Path       string // For example /share/example
+	Type       string // Either regular or symlink
+	Size       int64
+	Executable bool
+	Target     string // The target of a symlink
+}
+
+// lsEntry is an entry of a listing in the .ls JSON format, used to build listings which don't come from a binary cache.
+type lsEntry struct {
+	Type       string              `json:"type"`
+	Size       int64               `json:"size,omitempty"`
+	Executable bool                `json:"executable,omitempty"`
+	Target     string              `json:"target,omitempty"`
+	Entries    map[string]*lsEntry `json:"entries,omitempty"`
+}
+
+// encodeListing encodes the root entry like the listings of a binary cache.
+func encodeListing(root *lsEntry) ([]byte, error) {
+	return json.Marshal(struct {
+		Version int      `json:"version"`
+		Root    *lsEntry `json:"root"`
+	}{1, root})
+}
+
+// GetFileList converts the binary file listing into a list of files, for example [ /share/example ].
+func GetFileList(data []byte) ([]File, error) {
+	result := make([]File, 0)
+	err := DecodeListing(bytes.NewReader(data), func(file File) {
+		result = append(result, file)
+	})
+
+	return result, err
+}
+
+// DecodeListing walks a NAR listing in a single pass, calling emit for every regular file and symlink as it is decoded.
+// The keys of a listing are sorted, so the type of an entry is only known after its children have been walked.
+func DecodeListing(r io.Reader, emit func(File)) error {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	ld := listingDecoder{dec: dec, emit: emit}
+
+	if err := ld.delim('{'); err != nil {
+		return err
+	}
+
+	for dec.More() {
+		key, err := ld.key()
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "root":
+			err = ld.entry("")
+		default:
+			err = ld.skip()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return ld.delim('}')
+}
+
+// listingDecoder keeps the state of a listing walk.
+type listingDecoder struct {
+	dec  *json.Decoder
+	emit func(File)
+}
+
+// entry decodes a single entry of the listing, recursing into the directories.
+func (ld *listingDecoder) entry(path string) error {
+	if err := ld.delim('{'); err != nil {
+		return err
+	}
+
+	file := File{Path: path}
+	for ld.dec.More() {
+		key, err := ld.key()
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "type":
+			err = ld.dec.Decode(&file.Type)
+		case "size":
+			var size json.Number
+			if err = ld.dec.Decode(&size); err == nil {
+				file.Size, err = size.Int64()
+			}
+		case "executable":
+			err = ld.dec.Decode(&file.Executable)
+		case "target":
+			err = ld.dec.Decode(&file.Target)
+		case "entries":
+			err = ld.entries(path)
+		default:
+			err = ld.skip()
+		}
+		if err != nil {
+			return fmt.Errorf("decoding %q of %q: %w", key, path, err)
+		}
+	}
+
+	if err := ld.delim('}'); err != nil {
+		return err
+	}
+
+	if file.Type == "regular" || file.Type == "symlink" {
+		ld.emit(file)
+	}
+
+	return nil
+}
+
+// entries decodes the children of a directory.
+func (ld *listingDecoder) entries(path string) error {
+	if err := ld.delim('{'); err != nil {
+		return err
+	}
+
+	for ld.dec.More() {
+		name, err := ld.key()
+		if err != nil {
+			return err
+		}
+
+		if err := ld.entry(path + "/" + name); err != nil {
+			return err
+		}
+	}
+
+	return ld.delim('}')
+}
+
+// key reads an object key.
+func (ld *listingDecoder) key() (string, error) {
+	tok, err := ld.dec.Token()
+	if err != nil {
+		return "", err
+	}
+
+	key, ok := tok.(string)
+	if !ok {
+		return "", fmt.Errorf("expected an object key, got %v", tok)
+	}
+
+	return key, nil
+}
+
+// delim reads the expected delimiter.
+func (ld *listingDecoder) delim(want json.Delim) error {
+	tok, err := ld.dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if got, ok := tok.(json.Delim); !ok || got != want {
+		return fmt.Errorf("expected %v, got %v", want, tok)
+	}
+
+	return nil
+}
+
+// skip discards a value which isn't needed, like the NAR offsets.
+func (ld *listingDecoder) skip() error {
+	depth := 0
+	for {
+		tok, err := ld.dec.Token()
+		if err != nil {
+			return err
+		}
+
+		if delim, ok := tok.(json.Delim); ok {
+			switch delim {
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+			}
+		}
+
+		if depth == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package nixpkgs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// listingShape describes a synthetic listing, every directory has the same number of files and subdirectories.
+type listingShape struct {
+	Name   string
+	Depth  int // The number of directory levels below the root
+	Fanout int // The subdirectories of every directory above the last level
+	Files  int // The files of every directory
+}
+
+// The fixtures resemble the listings which are slow to index, a flat lib directory and the deep trees of the kernel headers.
+var listingShapes = []listingShape{
+	{Name: "wide", Depth: 1, Fanout: 16, Files: 1000},
+	{Name: "deep", Depth: 10, Fanout: 2, Files: 15},
+	{Name: "large", Depth: 5, Fanout: 4, Files: 30},
+}
+
+// genListing builds a listing in the format published by the binary caches including the NAR offsets, returning the
+// listing and the number of files in it. Every third file is executable and every fifth one is a symlink.
+func genListing(shape listingShape) ([]byte, int) {
+	files := 0
+	offset := 0
+	var dir func(level int) map[string]any
+	dir = func(level int) map[string]any {
+		entries := make(map[string]any)
+		for i := range shape.Files {
+			name := fmt.Sprintf("file-%d.so", i)
+			files++
+			if i%5 == 4 {
+				entries[name] = map[string]any{"type": "symlink", "target": fmt.Sprintf("file-%d.so", i-1)}
+				continue
+			}
+
+			offset += 1024 + i
+			entry := map[string]any{"type": "regular", "size": 512 + i, "narOffset": offset}
+			if i%3 == 0 {
+				entry["executable"] = true
+			}
+			entries[name] = entry
+		}
+
+		if level < shape.Depth {
+			for i := range shape.Fanout {
+				entries[fmt.Sprintf("dir-%d", i)] = dir(level + 1)
+			}
+		}
+
+		return map[string]any{"type": "directory", "entries": entries}
+	}
+
+	data, err := json.Marshal(map[string]any{"version": 1, "root": dir(0)})
+	if err != nil {
+		panic(err)
+	}
+
+	return data, files
+}
+
+func TestGetFileList(t *testing.T) {
+	data := []byte(`{"version":1,"root":{"type":"directory","entries":{
+		"bin":{"type":"directory","entries":{
+			"hello":{"type":"regular","size":42,"executable":true,"narOffset":400},
+			"hi":{"type":"symlink","target":"hello"}}},
+		"share":{"type":"directory","entries":{"empty":{"type":"directory","entries":{}}}}}}}`)
+
+	files, err := GetFileList(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []File{
+		{Path: "/bin/hello", Type: "regular", Size: 42, Executable: true},
+		{Path: "/bin/hi", Type: "symlink", Target: "hello"},
+	}
+	if !slices.Equal(files, want) {
+		t.Errorf("got %+v, want %+v", files, want)
+	}
+}
+
+func TestGetFileListSingleFile(t *testing.T) {
+	files, err := GetFileList([]byte(`{"version":1,"root":{"type":"regular","size":7,"narOffset":96}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []File{{Path: "", Type: "regular", Size: 7}}
+	if !slices.Equal(files, want) {
+		t.Errorf("got %+v, want %+v", files, want)
+	}
+}
+
+func TestGetFileListMalformed(t *testing.T) {
+	for name, data := range map[string]string{
+		"empty":     ``,
+		"array":     `[]`,
+		"truncated": `{"version":1,"root":{"type":"directory","entries":{"a":{"type":"regular"}`,
+		"bad size":  `{"version":1,"root":{"type":"regular","size":"big"}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := GetFileList([]byte(data)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestGetFileListKeepsDecodedFiles(t *testing.T) {
+	files, err := GetFileList([]byte(`{"version":1,"root":{"type":"directory","entries":{"a":{"type":"regular"},"b":{"type":`))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if len(files) != 1 || files[0].Path != "/a" {
+		t.Errorf("got %+v, want the file decoded before the error", files)
+	}
+}
+
+func TestGenListing(t *testing.T) {
+	for _, shape := range listingShapes {
+		t.Run(shape.Name, func(t *testing.T) {
+			data, count := genListing(shape)
+			files, err := GetFileList(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(files) != count {
+				t.Errorf("got %d files, want %d", len(files), count)
+			}
+		})
+	}
+}
+
+// bfsFileList is the decoder replaced by DecodeListing. It parses the whole listing and walks it breadth first, looking
+// up every node from the root like the GetByPath calls of the sonic version did. It is kept as the benchmark baseline.
+func bfsFileList(data []byte) ([]File, error) {
+	var root map[string]any
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+
+	result := make([]File, 0)
+	queue := [][]string{{"root"}}
+	for len(queue) != 0 {
+		path := queue[0]
+		queue = queue[1:]
+
+		item := root
+		for _, key := range path {
+			item, _ = item[key].(map[string]any)
+		}
+
+		switch item["type"] {
+		case "directory":
+			entries, _ := item["entries"].(map[string]any)
+			for key := range entries {
+				queue = append(queue, append(slices.Clone(path), "entries", key))
+			}
+
+		case "regular", "symlink":
+			file := File{Type: item["type"].(string)}
+			for i := 2; i < len(path); i += 2 {
+				file.Path += "/" + path[i]
+			}
+
+			size, _ := item["size"].(float64)
+			file.Size = int64(size)
+			file.Executable, _ = item["executable"].(bool)
+			file.Target, _ = item["target"].(string)
+			result = append(result, file)
+		}
+	}
+
+	return result, nil
+}
+
+func BenchmarkDecodeListingBFS(b *testing.B) {
+	for _, shape := range listingShapes {
+		data, count := genListing(shape)
+		b.Run(shape.Name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for b.Loop() {
+				files, err := bfsFileList(data)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				if len(files) != count {
+					b.Fatalf("got %d files, want %d", len(files), count)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeListing(b *testing.B) {
+	for _, shape := range listingShapes {
+		data, count := genListing(shape)
+		b.Run(shape.Name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for b.Loop() {
+				files := 0
+				if err := DecodeListing(bytes.NewReader(data), func(File) { files++ }); err != nil {
+					b.Fatal(err)
+				}
+
+				if files != count {
+					b.Fatalf("got %d files, want %d", files, count)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package nixpkgs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// DefaultStoreDir is the location of the nix store.
+const DefaultStoreDir = "/nix/store"
+
+// LocalStore reads the listings of the store paths which exist in a local nix store, no binary cache is needed.
+type LocalStore struct {
+	Dir string // For example /nix/store
+}
+
+// Listing walks the store path and encodes it like the listings of a binary cache.
+func (store *LocalStore) Listing(ctx context.Context, sp StorePath) (Fetched, error) {
+	fetched := Fetched{Source: "file://" + store.Dir}
+	path := filepath.Join(store.Dir, sp.Hash()+"-"+sp.Name())
+
+	root, err := walkStorePath(ctx, path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fetched, fmt.Errorf("%w: %s", ErrListingNotFound, path)
+		}
+
+		return fetched, err
+	}
+
+	fetched.Data, err = encodeListing(root)
+	return fetched, err
+}
+
+// walkStorePath builds the listing entry of a path without following symlinks.
+func walkStorePath(ctx context.Context, path string) (*lsEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return &lsEntry{Type: "symlink", Target: target}, nil
+
+	case info.IsDir():
+		dirEntries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := &lsEntry{Type: "directory", Entries: make(map[string]*lsEntry, len(dirEntries))}
+		for _, dirEntry := range dirEntries {
+			child, err := walkStorePath(ctx, filepath.Join(path, dirEntry.Name()))
+			if err != nil {
+				return nil, err
+			}
+			entry.Entries[dirEntry.Name()] = child
+		}
+
+		return entry, nil
+
+	case info.Mode().IsRegular():
+		return &lsEntry{Type: "regular", Size: info.Size(), Executable: info.Mode()&0o111 != 0}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported file type %s: %s", info.Mode().Type(), path)
+}
@@ -0,0 +1,299 @@
+package nixpkgs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+var (
+	ErrBadNAR      = errors.New("malformed NAR")
+	ErrNARMismatch = errors.New("the NAR doesn't match its narinfo")
+)
+
+// maxNARToken is the longest string of a NAR besides the file contents, nix limits the names and symlink targets to 4096 bytes.
+const maxNARToken = 4096
+
+// narCompressions are the NAR compressions supported by decompressNAR.
+var narCompressions = []string{"", "none", "xz", "zstd", "bzip2", "br"}
+
+// decompressNAR wraps the body of a downloaded NAR using the compression from its narinfo, the caller has to close the result.
+func decompressNAR(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case "", "none":
+		return io.NopCloser(r), nil
+	case "xz":
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrDecompression, err)
+		}
+		return io.NopCloser(xr), nil
+	case "zstd":
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrDecompression, err)
+		}
+		return zr.IOReadCloser(), nil
+	case "bzip2":
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), nil
+	}
+
+	return nil, fmt.Errorf("%w: unsupported compression %s", ErrDecompression, compression)
+}
+
+// narReader reads the tokens of a NAR, the file contents are skipped.
+type narReader struct {
+	r *bufio.Reader
+}
+
+// readNAR parses a NAR archive in a single pass and returns its listing, the file contents are discarded.
+func readNAR(r io.Reader) (*lsEntry, error) {
+	nr := narReader{r: bufio.NewReader(r)}
+	if err := nr.expect("nix-archive-1"); err != nil {
+		return nil, err
+	}
+
+	return nr.node()
+}
+
+// readVerifiedNAR parses the NAR like readNAR while hashing it, the NAR is rejected if its hash or size differ from the narinfo.
+func readVerifiedNAR(r io.Reader, info *NarInfo) (*lsEntry, error) {
+	want, err := info.narDigest()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	counter := &countingReader{r: io.TeeReader(r, h)}
+	root, err := readNAR(counter)
+	if err != nil {
+		return nil, err
+	}
+
+	// The bytes after the archive are part of the hash too
+	if _, err := io.Copy(io.Discard, counter); err != nil {
+		return nil, err
+	}
+
+	if info.NarSize != 0 && counter.n != info.NarSize {
+		return nil, fmt.Errorf("%w: got %d bytes, want %d", ErrNARMismatch, counter.n, info.NarSize)
+	}
+
+	if got := h.Sum(nil); !bytes.Equal(got, want) {
+		return nil, fmt.Errorf("%w: got the hash %x, want %x", ErrNARMismatch, got, want)
+	}
+
+	return root, nil
+}
+
+// countingReader counts the bytes read from the reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// node reads a `( type ... )` node.
+func (nr *narReader) node() (*lsEntry, error) {
+	if err := nr.expect("("); err != nil {
+		return nil, err
+	}
+
+	if err := nr.expect("type"); err != nil {
+		return nil, err
+	}
+
+	filetype, err := nr.str()
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &lsEntry{Type: filetype}
+	switch filetype {
+	case "regular":
+		tag, err := nr.str()
+		if err != nil {
+			return nil, err
+		}
+
+		if tag == "executable" {
+			entry.Executable = true
+			if err := nr.expect(""); err != nil {
+				return nil, err
+			}
+
+			if tag, err = nr.str(); err != nil {
+				return nil, err
+			}
+		}
+
+		if tag != "contents" {
+			return nil, fmt.Errorf("%w: expected contents, got %q", ErrBadNAR, tag)
+		}
+
+		if entry.Size, err = nr.skipContents(); err != nil {
+			return nil, err
+		}
+
+		return entry, nr.expect(")")
+
+	case "symlink":
+		if err := nr.expect("target"); err != nil {
+			return nil, err
+		}
+
+		if entry.Target, err = nr.str(); err != nil {
+			return nil, err
+		}
+
+		return entry, nr.expect(")")
+
+	case "directory":
+		entry.Entries = make(map[string]*lsEntry)
+		for {
+			tag, err := nr.str()
+			if err != nil {
+				return nil, err
+			}
+
+			if tag == ")" {
+				return entry, nil
+			}
+
+			if tag != "entry" {
+				return nil, fmt.Errorf("%w: expected entry, got %q", ErrBadNAR, tag)
+			}
+
+			name, child, err := nr.dirEntry()
+			if err != nil {
+				return nil, err
+			}
+			entry.Entries[name] = child
+		}
+	}
+
+	return nil, fmt.Errorf("%w: unknown type %q", ErrBadNAR, filetype)
+}
+
+// dirEntry reads a `( name ... node ... )` directory entry.
+func (nr *narReader) dirEntry() (string, *lsEntry, error) {
+	if err := nr.expect("("); err != nil {
+		return "", nil, err
+	}
+
+	if err := nr.expect("name"); err != nil {
+		return "", nil, err
+	}
+
+	name, err := nr.str()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if name == "" || name == "." || name == ".." {
+		return "", nil, fmt.Errorf("%w: invalid name %q", ErrBadNAR, name)
+	}
+
+	if err := nr.expect("node"); err != nil {
+		return "", nil, err
+	}
+
+	child, err := nr.node()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return name, child, nr.expect(")")
+}
+
+// expect reads a string and checks its value.
+func (nr *narReader) expect(want string) error {
+	got, err := nr.str()
+	if err != nil {
+		return err
+	}
+
+	if got != want {
+		return fmt.Errorf("%w: expected %q, got %q", ErrBadNAR, want, got)
+	}
+
+	return nil
+}
+
+// str reads a length prefixed and padded string.
+func (nr *narReader) str() (string, error) {
+	n, err := nr.length()
+	if err != nil {
+		return "", err
+	}
+
+	if n > maxNARToken {
+		return "", fmt.Errorf("%w: string of %d bytes", ErrBadNAR, n)
+	}
+
+	buf := make([]byte, padded(n))
+	if _, err := io.ReadFull(nr.r, buf); err != nil {
+		return "", nr.wrap(err)
+	}
+
+	return string(buf[:n]), nil
+}
+
+// skipContents discards the contents of a regular file and returns its size.
+func (nr *narReader) skipContents() (int64, error) {
+	n, err := nr.length()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := nr.r.Discard(int(padded(n))); err != nil {
+		return 0, nr.wrap(err)
+	}
+
+	return int64(n), nil
+}
+
+// length reads a little endian 64 bit length.
+func (nr *narReader) length() (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(nr.r, buf[:]); err != nil {
+		return 0, nr.wrap(err)
+	}
+
+	n := binary.LittleEndian.Uint64(buf[:])
+	if n > 1<<62 {
+		return 0, fmt.Errorf("%w: length %d", ErrBadNAR, n)
+	}
+
+	return n, nil
+}
+
+// wrap marks a truncated archive as malformed.
+func (nr *narReader) wrap(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: truncated", ErrBadNAR)
+	}
+
+	return err
+}
+
+// padded rounds the length up to the 8 byte alignment of NARs.
+func padded(n uint64) uint64 {
+	return (n + 7) &^ 7
+}
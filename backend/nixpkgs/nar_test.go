@@ -0,0 +1,175 @@
+package nixpkgs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// narTokens encodes the tokens as NAR strings, file contents are strings too.
+func narTokens(tokens ...string) []byte {
+	buf := bytes.Buffer{}
+	for _, token := range tokens {
+		binary.Write(&buf, binary.LittleEndian, uint64(len(token)))
+		buf.WriteString(token)
+		buf.Write(make([]byte, padded(uint64(len(token)))-uint64(len(token))))
+	}
+
+	return buf.Bytes()
+}
+
+// The tokens of the NAR nodes.
+func narFile(contents string, executable bool) []string {
+	if executable {
+		return []string{"(", "type", "regular", "executable", "", "contents", contents, ")"}
+	}
+
+	return []string{"(", "type", "regular", "contents", contents, ")"}
+}
+
+func narSymlink(target string) []string {
+	return []string{"(", "type", "symlink", "target", target, ")"}
+}
+
+func narDir(entries ...[]string) []string {
+	return append(append([]string{"(", "type", "directory"}, slices.Concat(entries...)...), ")")
+}
+
+func narEntry(name string, node []string) []string {
+	return append(append([]string{"entry", "(", "name", name, "node"}, node...), ")")
+}
+
+// narArchive builds a NAR with the root node.
+func narArchive(root []string) []byte {
+	return narTokens(append([]string{"nix-archive-1"}, root...)...)
+}
+
+func TestReadNAR(t *testing.T) {
+	nar := narArchive(narDir(
+		narEntry("bin", narDir(
+			narEntry("hello", narFile("#!/bin/sh\necho hello\n", true)),
+			narEntry("hi", narSymlink("hello")),
+		)),
+		narEntry("share", narDir(
+			narEntry("doc", narFile("twelve bytes", false)),
+			narEntry("empty", narDir()),
+		)),
+	))
+
+	root, err := readNAR(bytes.NewReader(nar))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &lsEntry{Type: "directory", Entries: map[string]*lsEntry{
+		"bin": {Type: "directory", Entries: map[string]*lsEntry{
+			"hello": {Type: "regular", Size: 21, Executable: true},
+			"hi":    {Type: "symlink", Target: "hello"},
+		}},
+		"share": {Type: "directory", Entries: map[string]*lsEntry{
+			"doc":   {Type: "regular", Size: 12},
+			"empty": {Type: "directory", Entries: map[string]*lsEntry{}},
+		}},
+	}}
+	if !reflect.DeepEqual(root, want) {
+		t.Errorf("got %+v, want %+v", root, want)
+	}
+}
+
+func TestReadNARSingleFile(t *testing.T) {
+	root, err := readNAR(bytes.NewReader(narArchive(narFile("", false))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := (&lsEntry{Type: "regular"}); !reflect.DeepEqual(root, want) {
+		t.Errorf("got %+v, want %+v", root, want)
+	}
+}
+
+func TestReadNARMalformed(t *testing.T) {
+	valid := narArchive(narDir(narEntry("a", narFile("contents", false))))
+	for name, nar := range map[string][]byte{
+		"empty":           nil,
+		"bad magic":       narTokens("nix-archive-2", "(", "type", "regular", "contents", "", ")"),
+		"truncated":       valid[:len(valid)-12],
+		"unknown type":    narArchive([]string{"(", "type", "fifo", ")"}),
+		"no contents":     narArchive([]string{"(", "type", "regular", "size", "1", ")"}),
+		"bad entry":       narArchive([]string{"(", "type", "directory", "file", ")"}),
+		"dot dot name":    narArchive(narDir(narEntry("..", narFile("", false)))),
+		"empty name":      narArchive(narDir(narEntry("", narFile("", false)))),
+		"long token":      append(narTokens("nix-archive-1", "(", "type"), binary.LittleEndian.AppendUint64(nil, maxNARToken+1)...),
+		"huge length":     append(narTokens("nix-archive-1"), binary.LittleEndian.AppendUint64(nil, 1<<63)...),
+		"missing symlink": narArchive([]string{"(", "type", "symlink", "name", "a", ")"}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := readNAR(bytes.NewReader(nar)); !errors.Is(err, ErrBadNAR) {
+				t.Errorf("got %v, want %v", err, ErrBadNAR)
+			}
+		})
+	}
+}
+
+func TestDecompressNAR(t *testing.T) {
+	nar := narArchive(narDir(narEntry("file", narFile("contents", true))))
+	compress := map[string]func(io.Writer) (io.WriteCloser, error){
+		"none": func(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil },
+		"xz":   func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) },
+		"zstd": func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) },
+		"br":   func(w io.Writer) (io.WriteCloser, error) { return brotli.NewWriter(w), nil },
+	}
+
+	for compression, newWriter := range compress {
+		t.Run(compression, func(t *testing.T) {
+			buf := bytes.Buffer{}
+			w, err := newWriter(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := w.Write(nar); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := decompressNAR(&buf, compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			root, err := readNAR(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if file := root.Entries["file"]; file == nil || file.Size != 8 || !file.Executable {
+				t.Errorf("got %+v, want an executable file of 8 bytes", file)
+			}
+		})
+	}
+
+	if _, err := decompressNAR(bytes.NewReader(nar), "gzip"); !errors.Is(err, ErrDecompression) {
+		t.Errorf("got %v, want %v", err, ErrDecompression)
+	}
+}
+
+// nopWriteCloser writes the uncompressed NARs.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
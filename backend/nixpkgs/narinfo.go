@@ -0,0 +1,138 @@
+package nixpkgs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrBadNarInfo = errors.New("malformed narinfo")
+
+// NarInfo is the metadata of a store path published by a binary cache.
+type NarInfo struct {
+	StorePath   StorePath
+	URL         string // Relative to the cache, for example nar/1bc7....nar.xz
+	Compression string // For example xz, zstd, bzip2 or none
+	FileHash    string
+	FileSize    int64
+	NarHash     string
+	NarSize     int64
+	References  []string // Base names of the referenced store paths, for example qzh70f91a8sc1kb0n9hbf52hcv3jgy68-glibc-2.40
+	Deriver     string
+	Sig         []string
+	CA          string
+}
+
+// ParseNarInfo parses the `Key: value` lines of a narinfo file.
+func ParseNarInfo(data []byte) (*NarInfo, error) {
+	info := &NarInfo{Compression: "bzip2"} // The default according to nix
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			return nil, fmt.Errorf("%w: bad line %q", ErrBadNarInfo, line)
+		}
+
+		var err error
+		switch key {
+		case "StorePath":
+			info.StorePath = StorePath(value)
+		case "URL":
+			info.URL = value
+		case "Compression":
+			info.Compression = value
+		case "FileHash":
+			info.FileHash = value
+		case "FileSize":
+			info.FileSize, err = strconv.ParseInt(value, 10, 64)
+		case "NarHash":
+			info.NarHash = value
+		case "NarSize":
+			info.NarSize, err = strconv.ParseInt(value, 10, 64)
+		case "References":
+			info.References = strings.Fields(value)
+		case "Deriver":
+			info.Deriver = value
+		case "Sig":
+			info.Sig = append(info.Sig, value)
+		case "CA":
+			info.CA = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrBadNarInfo, key, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadNarInfo, err)
+	}
+
+	if info.URL == "" {
+		return nil, fmt.Errorf("%w: no URL", ErrBadNarInfo)
+	}
+
+	return info, nil
+}
+
+// nixBase32 is the alphabet of the nix base32 encoding, which leaves out e, o, t and u.
+const nixBase32 = "0123456789abcdfghijklmnpqrsvwxyz"
+
+// narDigest decodes the sha256 NarHash, it is in the nix base32 or the hex encoding, for example sha256:0f5vh1dlcq....
+func (info *NarInfo) narDigest() ([]byte, error) {
+	value, ok := strings.CutPrefix(info.NarHash, "sha256:")
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported NarHash %q", ErrBadNarInfo, info.NarHash)
+	}
+
+	if len(value) == hex.EncodedLen(sha256.Size) {
+		digest, err := hex.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: NarHash: %w", ErrBadNarInfo, err)
+		}
+		return digest, nil
+	}
+
+	digest, err := decodeNixBase32(value, sha256.Size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: NarHash: %w", ErrBadNarInfo, err)
+	}
+
+	return digest, nil
+}
+
+// decodeNixBase32 decodes a hash of the size from the nix base32 encoding. Unlike the standard one it starts with the last
+// 5 bits of the hash.
+func decodeNixBase32(value string, size int) ([]byte, error) {
+	if len(value) != (size*8-1)/5+1 {
+		return nil, fmt.Errorf("%d characters for a %d byte hash", len(value), size)
+	}
+
+	digest := make([]byte, size)
+	for k := range len(value) {
+		digit := strings.IndexByte(nixBase32, value[k])
+		if digit < 0 {
+			return nil, fmt.Errorf("invalid character %q", value[k])
+		}
+
+		bit := (len(value) - 1 - k) * 5
+		i, j := bit/8, bit%8
+		digest[i] |= byte(digit << j)
+		if carry := digit >> (8 - j); i+1 < size {
+			digest[i+1] |= byte(carry)
+		} else if carry != 0 {
+			return nil, errors.New("excess bits")
+		}
+	}
+
+	return digest, nil
+}
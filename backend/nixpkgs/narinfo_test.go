@@ -0,0 +1,108 @@
+package nixpkgs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+const testNarInfo = `StorePath: /nix/store/qzh70f91a8sc1kb0n9hbf52hcv3jgy68-hello-2.12
+URL: nar/1bc7k1z0lh1cc5nqz8g1vk0avj0zmmr9arfw4vbxjmbzjpmjlfy8.nar.xz
+Compression: xz
+FileHash: sha256:1bc7k1z0lh1cc5nqz8g1vk0avj0zmmr9arfw4vbxjmbzjpmjlfy8
+FileSize: 50184
+NarHash: sha256:0f5vh1dlcq6qc2rrxzzrlgd8ivmmh5ld5mbf6zl6ypc2v1a87jfc
+NarSize: 226560
+References: qzh70f91a8sc1kb0n9hbf52hcv3jgy68-hello-2.12 3dyw8dzj9ab4m8hv5dpyx7zii8d0w6fi-glibc-2.40
+Deriver: 5m8yj2ypsrsmh2xb5wllh4abf7rnxd5w-hello-2.12.drv
+Sig: cache.nixos.org-1:first
+Sig: other-cache-1:second
+`
+
+func TestParseNarInfo(t *testing.T) {
+	info, err := ParseNarInfo([]byte(testNarInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &NarInfo{
+		StorePath:   "/nix/store/qzh70f91a8sc1kb0n9hbf52hcv3jgy68-hello-2.12",
+		URL:         "nar/1bc7k1z0lh1cc5nqz8g1vk0avj0zmmr9arfw4vbxjmbzjpmjlfy8.nar.xz",
+		Compression: "xz",
+		FileHash:    "sha256:1bc7k1z0lh1cc5nqz8g1vk0avj0zmmr9arfw4vbxjmbzjpmjlfy8",
+		FileSize:    50184,
+		NarHash:     "sha256:0f5vh1dlcq6qc2rrxzzrlgd8ivmmh5ld5mbf6zl6ypc2v1a87jfc",
+		NarSize:     226560,
+		References:  []string{"qzh70f91a8sc1kb0n9hbf52hcv3jgy68-hello-2.12", "3dyw8dzj9ab4m8hv5dpyx7zii8d0w6fi-glibc-2.40"},
+		Deriver:     "5m8yj2ypsrsmh2xb5wllh4abf7rnxd5w-hello-2.12.drv",
+		Sig:         []string{"cache.nixos.org-1:first", "other-cache-1:second"},
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("got %+v, want %+v", info, want)
+	}
+}
+
+func TestParseNarInfoDefaults(t *testing.T) {
+	info, err := ParseNarInfo([]byte("StorePath: /nix/store/qzh70f91a8sc1kb0n9hbf52hcv3jgy68-hello-2.12\nURL: nar/hello.nar.bz2\nReferences: \nUnknown: ignored\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Compression != "bzip2" {
+		t.Errorf("got compression %q, want the bzip2 default", info.Compression)
+	}
+
+	if len(info.References) != 0 {
+		t.Errorf("got references %v, want none", info.References)
+	}
+}
+
+func TestParseNarInfoMalformed(t *testing.T) {
+	for name, data := range map[string]string{
+		"empty":        "",
+		"no URL":       "StorePath: /nix/store/qzh70f91a8sc1kb0n9hbf52hcv3jgy68-hello-2.12\nNarSize: 1\n",
+		"bad line":     "URL: nar/hello.nar\nNarSize\n",
+		"bad nar size": "URL: nar/hello.nar\nNarSize: big\n",
+		"bad size":     "URL: nar/hello.nar\nFileSize: -\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseNarInfo([]byte(data)); !errors.Is(err, ErrBadNarInfo) {
+				t.Errorf("got %v, want %v", err, ErrBadNarInfo)
+			}
+		})
+	}
+}
+
+func TestNarDigest(t *testing.T) {
+	empty := sha256.Sum256(nil)
+	for _, narHash := range []string{
+		"sha256:0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73",
+		"sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	} {
+		digest, err := (&NarInfo{NarHash: narHash}).narDigest()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(digest, empty[:]) {
+			t.Errorf("%s: got %x, want the hash of nothing", narHash, digest)
+		}
+	}
+
+	for name, narHash := range map[string]string{
+		"empty":         "",
+		"sha512":        "sha512:0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73",
+		"short":         "sha256:0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c7",
+		"bad character": "sha256:0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c7e",
+		"excess bits":   "sha256:zmdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73",
+		"bad hex":       "sha256:g3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := (&NarInfo{NarHash: narHash}).narDigest(); !errors.Is(err, ErrBadNarInfo) {
+				t.Errorf("got %v, want %v", err, ErrBadNarInfo)
+			}
+		})
+	}
+}
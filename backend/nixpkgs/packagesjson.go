@@ -0,0 +1,280 @@
+package nixpkgs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/charmbracelet/log"
+)
+
+var (
+	ErrBadPackagesJSON = errors.New("malformed packages.json")
+	ErrNoPackages      = errors.New("no indexable packages")
+)
+
+// PackagesJSONTimeout limits the whole download of a package list, a stalled download would block the channel refresh forever.
+const PackagesJSONTimeout = 10 * time.Minute
+
+// channelClient downloads the package lists and checks the channel tarballs.
+var channelClient = &http.Client{Timeout: PackagesJSONTimeout}
+
+// maxDroppedOutputs is the share of the outputs of the system which may lack a store path, a release missing more of them
+// is rejected instead of replacing the channel with a fraction of it.
+const maxDroppedOutputs = 0.5
+
+// IsPackagesJSON reports if the channel is a prebuilt package list like the packages.json.br published with the channel releases,
+// for example https://channels.nixos.org/nixos-24.05/packages.json.br, instead of something for `nix-env --file`.
+func IsPackagesJSON(channel string) bool {
+	return strings.HasSuffix(channel, ".json") || strings.HasSuffix(channel, ".json.br")
+}
+
+// ConvertPackagesJSON reads a package list from a local file or an http(s) URL and streams the packages which can be indexed to
+// the writer as a channel file, files ending with .br are decompressed using brotli. Only the packages built for the system are
+// kept. The releases don't always include the store paths, outputs without one can't be indexed and are dropped.
+// ErrNoPackages is returned if nothing is left or too many outputs were dropped, the written channel is incomplete then.
+// The nixpkgs version is taken from the release directory, for example
+// https://releases.nixos.org/nixos/24.05/nixos-24.05.1503.752c634c09ce/packages.json.br, which the channel URLs redirect to.
+func ConvertPackagesJSON(channel, system string, w io.Writer) (Channel, error) {
+	body, meta, err := openPackagesJSON(channel)
+	if err != nil {
+		return meta, err
+	}
+	defer body.Close()
+
+	var r io.Reader = body
+	if strings.HasSuffix(channel, ".br") {
+		r = brotli.NewReader(body)
+	}
+
+	cw := newChannelWriter(w)
+	otherSystem, noPath, kept := 0, 0, 0
+	var writeErr error
+	err = decodePackagesJSON(json.NewDecoder(r), func(name string, pkg info) error {
+		if pkg.System != "" && pkg.System != system {
+			otherSystem++
+			return nil
+		}
+
+		for outname, sp := range pkg.Outputs {
+			if !strings.HasPrefix(string(sp), "/nix/store/") {
+				delete(pkg.Outputs, outname)
+				noPath++
+			}
+		}
+		kept += len(pkg.Outputs)
+
+		if len(pkg.Outputs) == 0 {
+			return nil
+		}
+
+		writeErr = cw.add(name, pkg)
+		return writeErr
+	})
+	if writeErr != nil {
+		return meta, writeErr
+	}
+
+	if err != nil {
+		return meta, fmt.Errorf("%w: %w", ErrBadPackagesJSON, err)
+	}
+
+	if err := cw.close(); err != nil {
+		return meta, err
+	}
+	meta.Packages = cw.count
+
+	if otherSystem != 0 || noPath != 0 {
+		log.Warn("Dropped packages which can't be indexed", "other_system", otherSystem, "outputs_without_path", noPath)
+	}
+
+	if kept == 0 {
+		return meta, fmt.Errorf("%w: no outputs with a store path for %s", ErrNoPackages, system)
+	}
+
+	if dropped := float64(noPath) / float64(noPath+kept); dropped > maxDroppedOutputs {
+		return meta, fmt.Errorf("%w: %.0f%% of the outputs for %s have no store path", ErrNoPackages, dropped*100, system)
+	}
+
+	return meta, nil
+}
+
+// channelWriter streams packages as a channel file, a JSON object of the packages by their attribute names.
+type channelWriter struct {
+	w     *bufio.Writer
+	enc   *json.Encoder
+	count int
+}
+
+func newChannelWriter(w io.Writer) *channelWriter {
+	bw := bufio.NewWriter(w)
+	return &channelWriter{w: bw, enc: json.NewEncoder(bw)}
+}
+
+// add writes a package.
+func (cw *channelWriter) add(name string, pkg info) error {
+	key, err := json.Marshal(name)
+	if err != nil {
+		return err
+	}
+
+	sep := byte(',')
+	if cw.count == 0 {
+		sep = '{'
+	}
+	cw.w.WriteByte(sep)
+	cw.w.Write(key)
+	cw.w.WriteByte(':')
+	cw.count++
+
+	return cw.enc.Encode(pkg)
+}
+
+// close ends the object and flushes the output.
+func (cw *channelWriter) close() error {
+	if cw.count == 0 {
+		cw.w.WriteByte('{')
+	}
+	cw.w.WriteByte('}')
+	return cw.w.Flush()
+}
+
+// openPackagesJSON opens the package list file or downloads it, the version and the date are read from the release if possible.
+func openPackagesJSON(channel string) (io.ReadCloser, Channel, error) {
+	meta := Channel{}
+	if !strings.HasPrefix(channel, "http://") && !strings.HasPrefix(channel, "https://") {
+		f, err := os.Open(channel)
+		if err != nil {
+			return nil, meta, err
+		}
+
+		meta.Version = releaseVersion(channel)
+		meta.Revision, meta.NixpkgsDate = parseVersion(meta.Version)
+		return f, meta, nil
+	}
+
+	resp, err := channelClient.Get(channel)
+	if err != nil {
+		return nil, meta, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, meta, fmt.Errorf("unexpected response while fetching %s: %s", channel, resp.Status)
+	}
+
+	meta.Version = releaseVersion(resp.Request.URL.Path) // The URL after the redirects
+	meta.Revision, meta.NixpkgsDate = parseVersion(meta.Version)
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil && meta.Version != "" && meta.NixpkgsDate.IsZero() {
+		meta.NixpkgsDate = modified.UTC() // The publishing date of the release
+	}
+
+	return resp.Body, meta, nil
+}
+
+// releaseVersion returns the nixpkgs version from the name of the release directory like nixos-24.05.1503.752c634c09ce,
+// an empty string if the file isn't in a release directory.
+func releaseVersion(file string) string {
+	release := path.Base(path.Dir(file))
+	for i, r := range release {
+		if r != '-' || i+1 == len(release) || release[i+1] < '0' || release[i+1] > '9' {
+			continue
+		}
+
+		version := release[i+1:]
+		if revision, _ := parseVersion(version); revision != "" {
+			return version
+		}
+	}
+
+	return ""
+}
+
+// decodePackagesJSON streams the packages to emit one by one. The newer releases wrap the packages in
+// {"version": 2, "packages": {...}}, the older ones are the plain output of `nix-env --query --json`.
+func decodePackagesJSON(dec *json.Decoder, emit func(name string, pkg info) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if tok != json.Delim('{') {
+		return errors.New("expected an object")
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key := tok.(string)
+
+		switch key {
+		case "version":
+			version := 0
+			if err := dec.Decode(&version); err != nil {
+				return err
+			}
+			if version != 2 {
+				return fmt.Errorf("unsupported version %d", version)
+			}
+
+		case "packages":
+			if err := decodePackages(dec, emit); err != nil {
+				return err
+			}
+
+		default:
+			if err := decodePackage(dec, key, emit); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = dec.Token()
+	return err
+}
+
+// decodePackages streams the object of the packages of the newer releases.
+func decodePackages(dec *json.Decoder, emit func(name string, pkg info) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if tok != json.Delim('{') {
+		return errors.New("expected an object of packages")
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		if err := decodePackage(dec, tok.(string), emit); err != nil {
+			return err
+		}
+	}
+
+	_, err = dec.Token()
+	return err
+}
+
+// decodePackage decodes a single package and passes it on.
+func decodePackage(dec *json.Decoder, name string, emit func(name string, pkg info) error) error {
+	pkg := info{}
+	if err := dec.Decode(&pkg); err != nil {
+		return fmt.Errorf("package %s: %w", name, err)
+	}
+
+	return emit(name, pkg)
+}
@@ -0,0 +1,88 @@
+package nixpkgs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeRelease writes a packages.json into a release directory and returns its path.
+func writeRelease(t *testing.T, data string) string {
+	dir := filepath.Join(t.TempDir(), "nixos-24.05.1503.752c634c09ce")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "packages.json")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestConvertPackagesJSON(t *testing.T) {
+	path := writeRelease(t, `{"version": 2, "packages": {
+		"hello": {"name": "hello-2.12", "system": "x86_64-linux", "outputs": {"out": "/nix/store/qzh70f91a8sc1kb0n9hbf52hcv3jgy68-hello-2.12"}},
+		"hello-arm": {"name": "hello-2.12", "system": "aarch64-linux", "outputs": {"out": "/nix/store/3dyw8dzj9ab4m8hv5dpyx7zii8d0w6fi-hello-2.12"}},
+		"curl": {"name": "curl-8.7.1", "system": "x86_64-linux", "outputs": {
+			"bin": "/nix/store/5m8yj2ypsrsmh2xb5wllh4abf7rnxd5w-curl-8.7.1-bin", "dev": null}}}}`)
+
+	buf := bytes.Buffer{}
+	meta, err := ConvertPackagesJSON(path, "x86_64-linux", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkgs := list{}
+	if err := json.Unmarshal(buf.Bytes(), &pkgs); err != nil {
+		t.Fatalf("the channel file isn't valid: %v", err)
+	}
+
+	if meta.Packages != len(pkgs) {
+		t.Errorf("got %d packages in the metadata, want %d", meta.Packages, len(pkgs))
+	}
+
+	if len(pkgs) != 2 || len(pkgs["curl"].Outputs) != 1 {
+		t.Errorf("got %+v, want hello and the curl output with a store path", pkgs)
+	}
+
+	if meta.Version != "24.05.1503.752c634c09ce" || meta.Revision != "752c634c09ce" {
+		t.Errorf("got version %q and revision %q", meta.Version, meta.Revision)
+	}
+}
+
+func TestConvertPackagesJSONNothingToIndex(t *testing.T) {
+	for name, data := range map[string]string{
+		"empty":        `{}`,
+		"other system": `{"hello": {"system": "aarch64-linux", "outputs": {"out": "/nix/store/qzh70f91a8sc1kb0n9hbf52hcv3jgy68-hello-2.12"}}}`,
+		"no paths":     `{"hello": {"system": "x86_64-linux", "outputs": {"out": null}}, "curl": {"outputs": {"out": ""}}}`,
+		"mostly no paths": `{"hello": {"outputs": {"out": "/nix/store/qzh70f91a8sc1kb0n9hbf52hcv3jgy68-hello-2.12"}},
+			"curl": {"outputs": {"bin": null, "dev": null}}}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ConvertPackagesJSON(writeRelease(t, data), "x86_64-linux", io.Discard); !errors.Is(err, ErrNoPackages) {
+				t.Errorf("got %v, want %v", err, ErrNoPackages)
+			}
+		})
+	}
+}
+
+func TestConvertPackagesJSONMalformed(t *testing.T) {
+	for name, data := range map[string]string{
+		"array":          `[]`,
+		"truncated":      `{"version": 2, "packages": {"hello": {"outputs": {"out": "/nix/store/qzh70f91a8sc1kb0n9hbf52hcv3jgy68-hello-2.12"}}`,
+		"newer version":  `{"version": 3, "packages": {}}`,
+		"packages array": `{"version": 2, "packages": []}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ConvertPackagesJSON(writeRelease(t, data), "x86_64-linux", io.Discard); !errors.Is(err, ErrBadPackagesJSON) {
+				t.Errorf("got %v, want %v", err, ErrBadPackagesJSON)
+			}
+		})
+	}
+}
@@ -1,11 +1,15 @@
 package nixpkgs
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"slices"
 	"sync"
+	"sync/atomic"
 
 	"github.com/TypicalAM/nix-hund/metrics"
 	"github.com/charmbracelet/log"
@@ -27,31 +31,24 @@ type info struct {
 // list is the nixpkgs package list.
 type list map[string]info
 
+// DefaultWorkers is the number of concurrent listing downloads used when no limit is set.
+const DefaultWorkers = 32
+
 // Pkgs is the package list fetcher
 type Pkgs struct {
-	CacheURL string
-	List     list
-	Fetcher  *retryhttp.Client
+	Source  Source // Where the listings come from
+	List    list
+	Workers int // Maximum number of concurrent listing downloads
 }
 
-// New reads or fetches the available packages from nixpkgs. It uses the specified channel and the cache url provided by the caller. Use `nixpkgs.AvailableChannels()` to get available channels.
-func New(url, channel, cacheDir string) (*Pkgs, error) {
-	cli := retryhttp.NewClient()
-	cli.RetryMax = 5
-	cli.Backoff = retryhttp.LinearJitterBackoff
-	cli.Logger = log.New(io.Discard)
-
-	cache := cacheDir
-	if cache == "" {
-		userCache, err := os.UserCacheDir()
-		if err != nil {
-			return nil, err
-		}
-		cache = userCache
+// New reads or fetches the available packages from nixpkgs. It uses the specified channel and the listing source provided by the caller. Use `nixpkgs.AvailableChannels()` to get available channels.
+func New(source Source, channel, cacheDir string) (*Pkgs, error) {
+	dir, err := ChannelsDir(cacheDir)
+	if err != nil {
+		return nil, err
 	}
 
-	dir := cache + "/nix-hund/channels/" + channel + ".json"
-	data, err := os.ReadFile(dir)
+	data, err := os.ReadFile(dir + "/" + channel + ".json")
 	if err != nil {
 		return nil, err
 	}
@@ -63,12 +60,21 @@ func New(url, channel, cacheDir string) (*Pkgs, error) {
 
 	metrics.PackageCount.Set(float64(len(pkgs)))
 	return &Pkgs{
-		CacheURL: url,
-		List:     pkgs,
-		Fetcher:  cli,
+		Source: source,
+		List:   pkgs,
 	}, nil
 }
 
+// NewFetcher creates the retrying HTTP client used to fetch the listings.
+func NewFetcher() *retryhttp.Client {
+	cli := retryhttp.NewClient()
+	cli.RetryMax = 5
+	cli.Backoff = retryhttp.LinearJitterBackoff
+	cli.Logger = log.New(io.Discard)
+	cli.ErrorHandler = retryhttp.PassthroughErrorHandler // Return the last response so that the status can be checked
+	return cli
+}
+
 // Count returns the total number of all derivations (NOT all outputs).
 func (pkgs Pkgs) Count() int {
 	return len(pkgs.List)
@@ -79,9 +85,20 @@ type RawListing struct {
 	PkgName    string
 	OutputName string
 	OutputHash string
+	StoreName  string
 	Version    string
 	Data       []byte
+	Cache      string   // The source which served the listing
+	NarInfo    *NarInfo // Nil if the source has no narinfo
 	Count      int
+	Err        error // Set if the listing couldn't be fetched
+}
+
+// FetchedNarInfo is the narinfo of an output fetched without its listing.
+type FetchedNarInfo struct {
+	Output  Output
+	NarInfo *NarInfo
+	Err     error // Set if the narinfo couldn't be fetched
 }
 
 // Listing is a listing broken down into individual files.
@@ -89,48 +106,72 @@ type Listing struct {
 	PkgName    string
 	OutputName string
 	OutputHash string
+	StoreName  string
 	Version    string
-	Files      []string
+	Files      []File
+	Cache      string
+	NarInfo    *NarInfo
 	Count      int
+	Err        error // Set if the listing couldn't be fetched or decoded, the output has no known files
 }
 
-// CountDev counts the development packages.
-func (pkgs *Pkgs) CountDev() int {
-	total := 0
+// OutputFilter is an allow-list of output names, the name "*" allows every output.
+type OutputFilter []string
 
-	for _, pkg := range pkgs.List {
-		for outname := range pkg.Outputs {
-			if outname == "dev" {
-				total++
-			}
-		}
-	}
+// DefaultOutputFilter is used when no filter is specified.
+var DefaultOutputFilter = OutputFilter{"dev"}
 
-	return total
+// Match checks if an output name is allowed by the filter.
+func (filter OutputFilter) Match(outname string) bool {
+	return slices.Contains(filter, "*") || slices.Contains(filter, outname)
 }
 
-// FetchListings fetches listings for all files.
-func (pkgs *Pkgs) FetchListings(total int) chan RawListing {
-	wg := sync.WaitGroup{}
-	rawListings := make(chan RawListing)
-	count := 0
+// Output is a single output of a derivation.
+type Output struct {
+	PkgName string
+	Name    string
+	Version string
+	Path    StorePath
+}
+
+// Outputs returns the outputs of all derivations which are allowed by the filter.
+func (pkgs *Pkgs) Outputs(filter OutputFilter) []Output {
+	outputs := make([]Output, 0)
 
 	for pkgName, pkg := range pkgs.List {
 		for outname, sp := range pkg.Outputs {
-			if outname != "dev" {
-				continue
+			if filter.Match(outname) {
+				outputs = append(outputs, Output{PkgName: pkgName, Name: outname, Version: pkg.Version, Path: sp})
 			}
-
-			wg.Add(1)
-			count++
-			go pkgs.fetchPackage(pkgName, sp, pkg.Version, outname, &wg, count, rawListings)
 		}
+	}
 
-		if count >= total {
-			break
-		}
+	return outputs
+}
+
+// FetchListings fetches listings for the specified outputs using a fixed pool of workers. No new fetches are started after the context is cancelled.
+func (pkgs *Pkgs) FetchListings(ctx context.Context, outputs []Output) chan RawListing {
+	workers := pkgs.workers()
+	wg := sync.WaitGroup{}
+	queue := make(chan int)
+	rawListings := make(chan RawListing, workers)
+
+	for range workers {
+		wg.Add(1)
+		go pkgs.fetchWorker(ctx, outputs, queue, &wg, rawListings)
 	}
 
+	go func() {
+		defer close(queue)
+		for i := range outputs {
+			select {
+			case queue <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
 	go func() {
 		wg.Wait()
 		close(rawListings)
@@ -139,39 +180,81 @@ func (pkgs *Pkgs) FetchListings(total int) chan RawListing {
 	return rawListings
 }
 
-// fetchPackage fetches a raw file listing.
-func (pkgs *Pkgs) fetchPackage(pkgName string, sp StorePath, version string, outname string, wg *sync.WaitGroup, count int, listings chan RawListing) {
+// fetchWorker fetches the queued outputs until the queue is closed.
+func (pkgs *Pkgs) fetchWorker(ctx context.Context, outputs []Output, queue chan int, wg *sync.WaitGroup, listings chan RawListing) {
 	defer wg.Done()
 
-	data, err := sp.FetchListing(pkgs.CacheURL, pkgs.Fetcher.StandardClient())
+	for i := range queue {
+		pkgs.fetchPackage(ctx, outputs[i], i+1, listings)
+	}
+}
+
+// fetchPackage fetches a raw file listing, failed fetches are passed on with the error set.
+func (pkgs *Pkgs) fetchPackage(ctx context.Context, output Output, count int, listings chan RawListing) {
+	fetched, err := pkgs.Source.Listing(ctx, output.Path)
 	if err != nil {
-		log.Error("Failed to fetch listing", "name", pkgName, "err", err)
-		return
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Error("Failed to fetch listing", "name", output.PkgName, "err", err)
 	}
 
-	listings <- RawListing{
-		PkgName:    pkgName,
-		OutputName: outname,
-		OutputHash: sp.Hash(),
-		Version:    version,
-		Data:       data,
+	select {
+	case listings <- RawListing{
+		PkgName:    output.PkgName,
+		OutputName: output.Name,
+		OutputHash: output.Path.Hash(),
+		StoreName:  output.Path.Name(),
+		Version:    output.Version,
+		Data:       fetched.Data,
+		Cache:      fetched.Source,
+		NarInfo:    fetched.NarInfo,
 		Count:      count,
+		Err:        err,
+	}:
+	case <-ctx.Done():
 	}
 }
 
-// ProcessListings processes a channel of packages into resolved file listings.
-func (pkgs *Pkgs) ProcessListings(rawPkgs chan RawListing) chan Listing {
+// FetchNarInfos fetches only the narinfo files of the outputs using a fixed pool of workers, for outputs whose files are already known.
+// Sources which don't publish narinfo files are skipped.
+func (pkgs *Pkgs) FetchNarInfos(ctx context.Context, outputs []Output) chan FetchedNarInfo {
+	workers := pkgs.workers()
 	wg := sync.WaitGroup{}
-	result := make(chan Listing)
-	count := 0
+	queue := make(chan Output)
+	result := make(chan FetchedNarInfo, workers)
+
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for output := range queue {
+				fetched := FetchedNarInfo{Output: output, Err: ErrListingNotFound}
+				if source, ok := pkgs.Source.(NarInfoSource); ok {
+					fetched.NarInfo, fetched.Err = source.NarInfo(ctx, output.Path)
+				}
+
+				select {
+				case result <- fetched:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
 
 	go func() {
-		for raw := range rawPkgs {
-			wg.Add(1)
-			count++
-			go pkgs.processInfo(raw, result, &wg, count)
+		defer close(queue)
+		for _, output := range outputs {
+			select {
+			case queue <- output:
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
 
+	go func() {
 		wg.Wait()
 		close(result)
 	}()
@@ -179,17 +262,63 @@ func (pkgs *Pkgs) ProcessListings(rawPkgs chan RawListing) chan Listing {
 	return result
 }
 
-// processInfo resolves the raw listing info to a filelist, and saves it to disk.
-func (pkgs *Pkgs) processInfo(raw RawListing, listings chan Listing, wg *sync.WaitGroup, count int) {
-	defer wg.Done()
+// ProcessListings processes a channel of packages into resolved file listings using a fixed pool of workers.
+func (pkgs *Pkgs) ProcessListings(rawPkgs chan RawListing) chan Listing {
+	workers := pkgs.workers()
+	wg := sync.WaitGroup{}
+	result := make(chan Listing, workers)
+	count := atomic.Int64{}
+
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for raw := range rawPkgs {
+				pkgs.processInfo(raw, result, int(count.Add(1)))
+			}
+		}()
+	}
 
-	filelist := GetFileList(raw.Data)
-	listings <- Listing{
+	go func() {
+		wg.Wait()
+		close(result)
+	}()
+
+	return result
+}
+
+// processInfo resolves the raw listing info to a filelist.
+func (pkgs *Pkgs) processInfo(raw RawListing, listings chan Listing, count int) {
+	listing := Listing{
 		PkgName:    raw.PkgName,
 		OutputName: raw.OutputName,
 		OutputHash: raw.OutputHash,
+		StoreName:  raw.StoreName,
 		Version:    raw.Version,
-		Files:      filelist,
+		Cache:      raw.Cache,
+		NarInfo:    raw.NarInfo,
 		Count:      count,
+		Err:        raw.Err,
 	}
+
+	if raw.Err == nil {
+		filelist, err := GetFileList(raw.Data)
+		if err != nil {
+			log.Error("Failed to decode listing", "name", raw.PkgName, "err", err)
+			listing.Err = fmt.Errorf("%w: %w", ErrMalformedListing, err)
+		} else {
+			listing.Files = filelist
+		}
+	}
+
+	listings <- listing
+}
+
+// workers returns the size of the worker pools.
+func (pkgs *Pkgs) workers() int {
+	if pkgs.Workers <= 0 {
+		return DefaultWorkers
+	}
+
+	return pkgs.Workers
 }
@@ -0,0 +1,83 @@
+package nixpkgs
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultTrustedKeys is the key of the official binary cache.
+const DefaultTrustedKeys = "cache.nixos.org-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY="
+
+var ErrUnverified = errors.New("no valid signature from a trusted key")
+
+// PublicKey is a named ed25519 key which signs narinfo files, for example cache.nixos.org-1.
+type PublicKey struct {
+	Name string
+	Key  ed25519.PublicKey
+}
+
+// ParsePublicKeys parses a space or comma separated list of `name:base64` keys, like trusted-public-keys in nix.conf.
+func ParsePublicKeys(value string) ([]PublicKey, error) {
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+
+	keys := make([]PublicKey, 0, len(fields))
+	for _, field := range fields {
+		name, encoded, ok := strings.Cut(field, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid public key %q: expected name:key", field)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key %q: %w", field, err)
+		}
+
+		if len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid public key %q: expected %d bytes, got %d", field, ed25519.PublicKeySize, len(key))
+		}
+
+		keys = append(keys, PublicKey{Name: name, Key: key})
+	}
+
+	return keys, nil
+}
+
+// Fingerprint returns the data signed by the caches: `1;<store path>;<nar hash>;<nar size>;<comma separated references>`.
+func (info *NarInfo) Fingerprint() string {
+	references := make([]string, len(info.References))
+	for i, reference := range info.References {
+		references[i] = "/nix/store/" + reference
+	}
+
+	return "1;" + string(info.StorePath) + ";" + info.NarHash + ";" + strconv.FormatInt(info.NarSize, 10) + ";" + strings.Join(references, ",")
+}
+
+// Verify returns the error ErrUnverified unless one of the signatures was made by a trusted key.
+func (info *NarInfo) Verify(keys []PublicKey) error {
+	fingerprint := []byte(info.Fingerprint())
+	for _, sig := range info.Sig {
+		name, encoded, ok := strings.Cut(sig, ":")
+		if !ok {
+			continue
+		}
+
+		signature, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(signature) != ed25519.SignatureSize {
+			continue
+		}
+
+		for _, key := range keys {
+			if key.Name == name && ed25519.Verify(key.Key, fingerprint, signature) {
+				return nil
+			}
+		}
+	}
+
+	return ErrUnverified
+}
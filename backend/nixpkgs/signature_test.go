@@ -0,0 +1,119 @@
+package nixpkgs
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+// The keys are derived from fixed seeds so that the signatures are reproducible.
+var (
+	testKey  = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	otherKey = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize))
+)
+
+// signedNarInfo returns a narinfo signed by the test key under the name.
+func signedNarInfo(name string) *NarInfo {
+	info := &NarInfo{
+		StorePath:  "/nix/store/qzh70f91a8sc1kb0n9hbf52hcv3jgy68-hello-2.12",
+		URL:        "nar/hello.nar.xz",
+		NarHash:    "sha256:0f5vh1dlcq6qc2rrxzzrlgd8ivmmh5ld5mbf6zl6ypc2v1a87jfc",
+		NarSize:    226560,
+		References: []string{"3dyw8dzj9ab4m8hv5dpyx7zii8d0w6fi-glibc-2.40", "qzh70f91a8sc1kb0n9hbf52hcv3jgy68-hello-2.12"},
+	}
+
+	sig := ed25519.Sign(testKey, []byte(info.Fingerprint()))
+	info.Sig = []string{name + ":" + base64.StdEncoding.EncodeToString(sig)}
+	return info
+}
+
+func TestFingerprint(t *testing.T) {
+	want := "1;/nix/store/qzh70f91a8sc1kb0n9hbf52hcv3jgy68-hello-2.12;sha256:0f5vh1dlcq6qc2rrxzzrlgd8ivmmh5ld5mbf6zl6ypc2v1a87jfc;226560;" +
+		"/nix/store/3dyw8dzj9ab4m8hv5dpyx7zii8d0w6fi-glibc-2.40,/nix/store/qzh70f91a8sc1kb0n9hbf52hcv3jgy68-hello-2.12"
+	if got := signedNarInfo("test-1").Fingerprint(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	info := &NarInfo{StorePath: "/nix/store/qzh70f91a8sc1kb0n9hbf52hcv3jgy68-hello-2.12", NarHash: "sha256:0", NarSize: 1}
+	if got, want := info.Fingerprint(), "1;/nix/store/qzh70f91a8sc1kb0n9hbf52hcv3jgy68-hello-2.12;sha256:0;1;"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	keys := []PublicKey{
+		{Name: "other-1", Key: otherKey.Public().(ed25519.PublicKey)},
+		{Name: "test-1", Key: testKey.Public().(ed25519.PublicKey)},
+	}
+
+	tests := []struct {
+		name   string
+		modify func(info *NarInfo)
+		valid  bool
+	}{
+		{name: "valid signature", modify: func(info *NarInfo) {}, valid: true},
+		{name: "valid among other signatures", modify: func(info *NarInfo) {
+			info.Sig = append([]string{"other-1:bm90IGEgc2lnbmF0dXJl", "broken"}, info.Sig...)
+		}, valid: true},
+		{name: "wrong key name", modify: func(info *NarInfo) {
+			*info = *signedNarInfo("other-1")
+		}},
+		{name: "unknown key name", modify: func(info *NarInfo) {
+			*info = *signedNarInfo("unknown-1")
+		}},
+		{name: "tampered nar size", modify: func(info *NarInfo) { info.NarSize++ }},
+		{name: "tampered nar hash", modify: func(info *NarInfo) { info.NarHash = "sha256:1" + info.NarHash[8:] }},
+		{name: "tampered references", modify: func(info *NarInfo) { info.References = info.References[1:] }},
+		{name: "tampered store path", modify: func(info *NarInfo) { info.StorePath += "-dev" }},
+		{name: "no signature", modify: func(info *NarInfo) { info.Sig = nil }},
+		{name: "no name", modify: func(info *NarInfo) { info.Sig[0] = info.Sig[0][len("test-1:"):] }},
+		{name: "malformed base64", modify: func(info *NarInfo) { info.Sig[0] += "!" }},
+		{name: "short signature", modify: func(info *NarInfo) { info.Sig[0] = "test-1:" + base64.StdEncoding.EncodeToString([]byte("short")) }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info := signedNarInfo("test-1")
+			test.modify(info)
+
+			err := info.Verify(keys)
+			if test.valid && err != nil {
+				t.Errorf("got %v, want a valid signature", err)
+			}
+
+			if !test.valid && !errors.Is(err, ErrUnverified) {
+				t.Errorf("got %v, want %v", err, ErrUnverified)
+			}
+		})
+	}
+
+	if err := signedNarInfo("test-1").Verify(nil); !errors.Is(err, ErrUnverified) {
+		t.Errorf("got %v without trusted keys, want %v", err, ErrUnverified)
+	}
+}
+
+func TestParsePublicKeys(t *testing.T) {
+	keys, err := ParsePublicKeys(DefaultTrustedKeys + ", test-1:" + base64.StdEncoding.EncodeToString(testKey.Public().(ed25519.PublicKey)) + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 2 || keys[0].Name != "cache.nixos.org-1" || keys[1].Name != "test-1" || !keys[1].Key.Equal(testKey.Public()) {
+		t.Errorf("got %+v, want the default key and the test key", keys)
+	}
+
+	for name, value := range map[string]string{
+		"no name":    ":6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY=",
+		"no key":     "cache.nixos.org-1",
+		"bad base64": "cache.nixos.org-1:%%%%",
+		"short key":  "cache.nixos.org-1:c2hvcnQ=",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParsePublicKeys(value); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package nixpkgs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	retryhttp "github.com/hashicorp/go-retryablehttp"
+)
+
+// Source provides the file listings of store paths in the .ls JSON format.
+type Source interface {
+	// Listing returns the listing of the store path along with the place which served it.
+	Listing(ctx context.Context, sp StorePath) (Fetched, error)
+}
+
+// Fetched is a listing returned by a source.
+type Fetched struct {
+	Data    []byte
+	Source  string   // The place which served the listing, for example the cache URL
+	NarInfo *NarInfo // Nil if the source doesn't publish narinfo files
+}
+
+// NARSource is a source which can also build the listings by downloading and parsing the whole NARs, which is a lot slower.
+type NARSource interface {
+	Source
+	// NARListing builds the listing of the store path from its NAR, ErrListingNotFound is returned if the source can't do that.
+	NARListing(ctx context.Context, sp StorePath) (Fetched, error)
+}
+
+// NarInfoSource is a source which publishes the narinfo files separately from the listings.
+type NarInfoSource interface {
+	Source
+	// NarInfo returns the narinfo of the store path, ErrListingNotFound is returned if the source doesn't have it.
+	NarInfo(ctx context.Context, sp StorePath) (*NarInfo, error)
+}
+
+// Sources tries every source in order, a missing listing is only reported if every source is missing it.
+// Otherwise the first other error is returned.
+type Sources []Source
+
+// Listing returns the listing from the first source which has it. Only if every source is missing the listing the NARs
+// of the sources supporting it are tried in the same order.
+func (sources Sources) Listing(ctx context.Context, sp StorePath) (Fetched, error) {
+	fetched, err := sources.first(ctx, func(source Source) (Fetched, error) {
+		return source.Listing(ctx, sp)
+	})
+	if !errors.Is(err, ErrListingNotFound) {
+		return fetched, err
+	}
+
+	narFetched, narErr := sources.first(ctx, func(source Source) (Fetched, error) {
+		if narSource, ok := source.(NARSource); ok {
+			return narSource.NARListing(ctx, sp)
+		}
+
+		return Fetched{}, ErrListingNotFound
+	})
+	if errors.Is(narErr, ErrListingNotFound) {
+		return fetched, err // The NAR fallback is disabled or the NARs are missing too
+	}
+
+	return narFetched, narErr
+}
+
+// NarInfo returns the narinfo from the first source which has it.
+func (sources Sources) NarInfo(ctx context.Context, sp StorePath) (*NarInfo, error) {
+	fetched, err := sources.first(ctx, func(source Source) (Fetched, error) {
+		infoSource, ok := source.(NarInfoSource)
+		if !ok {
+			return Fetched{}, ErrListingNotFound
+		}
+
+		info, err := infoSource.NarInfo(ctx, sp)
+		return Fetched{NarInfo: info}, err
+	})
+
+	return fetched.NarInfo, err
+}
+
+// first returns the result of the first source for which the fetch succeeds.
+func (sources Sources) first(ctx context.Context, fetch func(Source) (Fetched, error)) (Fetched, error) {
+	var firstErr, notFoundErr error
+	for _, source := range sources {
+		fetched, err := fetch(source)
+		if err == nil {
+			return fetched, nil
+		}
+
+		if ctx.Err() != nil {
+			return Fetched{}, ctx.Err()
+		}
+
+		if errors.Is(err, ErrListingNotFound) {
+			notFoundErr = err
+		} else if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr != nil {
+		return Fetched{}, firstErr
+	}
+
+	if notFoundErr == nil {
+		return Fetched{}, ErrNoCache
+	}
+
+	if len(sources) > 1 {
+		return Fetched{}, fmt.Errorf("%w in any of the %d sources", ErrListingNotFound, len(sources))
+	}
+
+	return Fetched{}, notFoundErr
+}
+
+// BinaryCache fetches the listings from a binary cache, for example http://cache.nixos.org.
+type BinaryCache struct {
+	URL         string
+	Fetcher     *retryhttp.Client
+	NARFallback bool // Download the whole NAR if no source publishes the .ls listing
+}
+
+// NewBinaryCache creates a binary cache source.
+func NewBinaryCache(url string, narFallback bool) *BinaryCache {
+	return &BinaryCache{URL: url, Fetcher: NewFetcher(), NARFallback: narFallback}
+}
+
+// Listing fetches the narinfo and the listing from the cache.
+func (cache *BinaryCache) Listing(ctx context.Context, sp StorePath) (Fetched, error) {
+	fetched := Fetched{Source: cache.URL}
+	cli := cache.Fetcher.StandardClient()
+
+	// The listing is still usable without the metadata
+	info, _ := sp.FetchNarInfo(ctx, cache.URL, cli)
+	if ctx.Err() != nil {
+		return fetched, ctx.Err()
+	}
+	fetched.NarInfo = info
+
+	data, err := sp.FetchListing(ctx, cache.URL, cli)
+	fetched.Data = data
+	return fetched, err
+}
+
+// NarInfo fetches only the narinfo from the cache.
+func (cache *BinaryCache) NarInfo(ctx context.Context, sp StorePath) (*NarInfo, error) {
+	return sp.FetchNarInfo(ctx, cache.URL, cache.Fetcher.StandardClient())
+}
+
+// NARListing builds the listing from the NAR described by the narinfo, if the NAR fallback is enabled.
+func (cache *BinaryCache) NARListing(ctx context.Context, sp StorePath) (Fetched, error) {
+	fetched := Fetched{Source: cache.URL}
+	if !cache.NARFallback {
+		return fetched, fmt.Errorf("%w: the NAR fallback is disabled for %s", ErrListingNotFound, cache.URL)
+	}
+
+	info, err := sp.FetchNarInfo(ctx, cache.URL, cache.Fetcher.StandardClient())
+	if err != nil {
+		return fetched, err
+	}
+	fetched.NarInfo = info
+
+	fetched.Data, err = cache.narListing(ctx, info)
+	return fetched, err
+}
+
+// narListing builds the listing by downloading and parsing the NAR described by the narinfo, checking its hash and size.
+func (cache *BinaryCache) narListing(ctx context.Context, info *NarInfo) ([]byte, error) {
+	cli := cache.Fetcher.StandardClient()
+
+	if !slices.Contains(narCompressions, info.Compression) {
+		return nil, fmt.Errorf("%w: unsupported compression %s", ErrDecompression, info.Compression)
+	}
+
+	resp, err := get(ctx, cli, cache.URL+"/"+info.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	r, err := decompressNAR(resp.Body, info.Compression)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	root, err := readVerifiedNAR(r, info)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeListing(root)
+}
+
+// ParseSubstituters parses a space or comma separated list of binary cache URLs, the order is the priority.
+func ParseSubstituters(value string) ([]string, error) {
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+
+	result := make([]string, 0, len(fields))
+	for _, field := range fields {
+		parsed, err := url.Parse(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid substituter %q: %w", field, err)
+		}
+
+		if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid substituter %q: only http and https caches are supported", field)
+		}
+
+		result = append(result, strings.TrimSuffix(field, "/"))
+	}
+
+	return result, nil
+}
@@ -0,0 +1,161 @@
+package nixpkgs
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const testStorePath = StorePath("/nix/store/qzh70f91a8sc1kb0n9hbf52hcv3jgy68-hello-2.12")
+
+// fakeCache serves the files of a binary cache, the other paths respond with the status.
+type fakeCache struct {
+	files  map[string]string
+	status int
+	nars   atomic.Int32 // The number of NAR downloads
+}
+
+func (fc *fakeCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/nar/") {
+		fc.nars.Add(1)
+	}
+
+	if data, ok := fc.files[r.URL.Path]; ok {
+		w.Write([]byte(data))
+		return
+	}
+
+	w.WriteHeader(fc.status)
+}
+
+// newTestCache starts a fake cache and returns its source.
+func newTestCache(t *testing.T, fc *fakeCache, narFallback bool) *BinaryCache {
+	srv := httptest.NewServer(fc)
+	t.Cleanup(srv.Close)
+
+	cache := NewBinaryCache(srv.URL, narFallback)
+	cache.Fetcher.RetryMax = 0
+	return cache
+}
+
+// testNAR is the NAR of the test store path.
+var testNAR = narArchive(narDir(narEntry("bin", narDir(narEntry("hello", narFile("hello", true))))))
+
+// narCache publishes the narinfo and the NAR of the test store path, but not its listing.
+func narCache() *fakeCache {
+	return narCacheWith(testNAR, fmt.Sprintf("sha256:%x", sha256.Sum256(testNAR)), len(testNAR))
+}
+
+// narCacheWith publishes the NAR with the hash and size of its narinfo.
+func narCacheWith(nar []byte, narHash string, narSize int) *fakeCache {
+	info := fmt.Sprintf("StorePath: %s\nURL: nar/hello.nar\nCompression: none\nNarHash: %s\nNarSize: %d\n", testStorePath, narHash, narSize)
+	return &fakeCache{status: http.StatusNotFound, files: map[string]string{
+		"/" + testStorePath.Hash() + ".narinfo": info,
+		"/nar/hello.nar":                        string(nar),
+	}}
+}
+
+// listingCache publishes only the listing of the test store path.
+func listingCache() *fakeCache {
+	return &fakeCache{status: http.StatusNotFound, files: map[string]string{
+		"/" + testStorePath.Hash() + ".ls": `{"version":1,"root":{"type":"directory","entries":{"share":{"type":"regular","size":1}}}}`,
+	}}
+}
+
+func TestSourcesListingPrefersListings(t *testing.T) {
+	nars, listings := narCache(), listingCache()
+	sources := Sources{newTestCache(t, nars, true), newTestCache(t, listings, true)}
+
+	fetched, err := sources.Listing(context.Background(), testStorePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fetched.Source != sources[1].(*BinaryCache).URL {
+		t.Errorf("got the listing from %s, want the cache with the listing", fetched.Source)
+	}
+
+	if n := nars.nars.Load(); n != 0 {
+		t.Errorf("downloaded %d NARs, want none", n)
+	}
+}
+
+func TestSourcesListingNARFallback(t *testing.T) {
+	sources := Sources{newTestCache(t, listingCache(), true), newTestCache(t, narCache(), true)}
+	missing := StorePath("/nix/store/0000000000000000000000000000000a-hello-2.12")
+	if _, err := sources.Listing(context.Background(), missing); !errors.Is(err, ErrListingNotFound) {
+		t.Errorf("got %v, want %v", err, ErrListingNotFound)
+	}
+
+	sources = Sources{newTestCache(t, narCache(), true)}
+	fetched, err := sources.Listing(context.Background(), testStorePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := GetFileList(fetched.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || files[0].Path != "/bin/hello" || !files[0].Executable {
+		t.Errorf("got %+v, want the executable from the NAR", files)
+	}
+
+	if fetched.NarInfo == nil || fetched.NarInfo.NarSize != int64(len(testNAR)) {
+		t.Errorf("got %+v, want the narinfo of the NAR", fetched.NarInfo)
+	}
+}
+
+func TestSourcesListingNARMismatch(t *testing.T) {
+	sum := sha256.Sum256(testNAR)
+	other := narArchive(narDir(narEntry("bin", narDir(narEntry("hello", narFile("tampered", true))))))
+	for name, cache := range map[string]*fakeCache{
+		"other NAR":      narCacheWith(other, fmt.Sprintf("sha256:%x", sum), len(other)),
+		"wrong size":     narCacheWith(testNAR, fmt.Sprintf("sha256:%x", sum), len(testNAR)+8),
+		"trailing bytes": narCacheWith(append(testNAR, 0), fmt.Sprintf("sha256:%x", sum), len(testNAR)+1),
+	} {
+		t.Run(name, func(t *testing.T) {
+			sources := Sources{newTestCache(t, cache, true)}
+			if _, err := sources.Listing(context.Background(), testStorePath); !errors.Is(err, ErrNARMismatch) {
+				t.Errorf("got %v, want %v", err, ErrNARMismatch)
+			}
+		})
+	}
+
+	sources := Sources{newTestCache(t, narCacheWith(testNAR, "", len(testNAR)), true)}
+	if _, err := sources.Listing(context.Background(), testStorePath); !errors.Is(err, ErrBadNarInfo) {
+		t.Errorf("got %v without a NarHash, want %v", err, ErrBadNarInfo)
+	}
+}
+
+func TestSourcesListingNARFallbackDisabled(t *testing.T) {
+	nars := narCache()
+	sources := Sources{newTestCache(t, nars, false)}
+	if _, err := sources.Listing(context.Background(), testStorePath); !errors.Is(err, ErrListingNotFound) {
+		t.Errorf("got %v, want %v", err, ErrListingNotFound)
+	}
+
+	if n := nars.nars.Load(); n != 0 {
+		t.Errorf("downloaded %d NARs, want none", n)
+	}
+}
+
+func TestSourcesListingNoFallbackOnError(t *testing.T) {
+	nars := narCache()
+	down := &fakeCache{status: http.StatusServiceUnavailable}
+	sources := Sources{newTestCache(t, down, true), newTestCache(t, nars, true)}
+	if _, err := sources.Listing(context.Background(), testStorePath); !errors.Is(err, ErrCacheUnavailable) {
+		t.Errorf("got %v, want %v", err, ErrCacheUnavailable)
+	}
+
+	if n := nars.nars.Load(); n != 0 {
+		t.Errorf("downloaded %d NARs, want none", n)
+	}
+}
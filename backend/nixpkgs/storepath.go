@@ -1,6 +1,8 @@
 package nixpkgs
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -8,10 +10,15 @@ import (
 	"strings"
 
 	"github.com/andybalholm/brotli"
-	"github.com/bytedance/sonic"
 	"github.com/ulikunitz/xz"
 )
 
+var (
+	ErrListingNotFound  = errors.New("listing not found in the cache")
+	ErrCacheUnavailable = errors.New("cache unavailable")
+	ErrDecompression    = errors.New("decompressing the listing failed")
+)
+
 // StorePath contains information about an outputs store path.
 type StorePath string
 
@@ -30,10 +37,9 @@ func (sp StorePath) Hash() string {
 }
 
 // FileListing fetches the file listing for the package using nix binary cache provided a cache URL for example http://cache.nixos.org.
-// It also does the ugly parts like decompression.
-func (sp StorePath) FetchListing(url string, cli *http.Client) ([]byte, error) {
-	listingURL := fmt.Sprintf("%s/%s.ls", url, sp.Hash())
-	resp, err := cli.Get(listingURL)
+// It also does the ugly parts like decompression. A missing listing returns ErrListingNotFound, server and network errors return ErrCacheUnavailable.
+func (sp StorePath) FetchListing(ctx context.Context, url string, cli *http.Client) ([]byte, error) {
+	resp, err := get(ctx, cli, fmt.Sprintf("%s/%s.ls", url, sp.Hash()))
 	if err != nil {
 		return nil, err
 	}
@@ -43,7 +49,7 @@ func (sp StorePath) FetchListing(url string, cli *http.Client) ([]byte, error) {
 		// Compressed using brotli (most new pkgs)
 		data, err := io.ReadAll(brotli.NewReader(resp.Body))
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: %w", ErrDecompression, err)
 		}
 
 		return data, nil
@@ -53,12 +59,12 @@ func (sp StorePath) FetchListing(url string, cli *http.Client) ([]byte, error) {
 		// Compressed using xz
 		r, err := xz.NewReader(resp.Body)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: %w", ErrDecompression, err)
 		}
 
 		data, err := io.ReadAll(r)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: %w", ErrDecompression, err)
 		}
 
 		return data, nil
@@ -73,42 +79,54 @@ func (sp StorePath) FetchListing(url string, cli *http.Client) ([]byte, error) {
 	return data, nil
 }
 
-// GetFileList converts the binary file listing into a list of paths, for example [ /share/example ].
-func GetFileList(data []byte) []string {
-	result := make([]string, 0)
-	root, _ := sonic.Get(data)
-
-	queue := [][]interface{}{{"root"}}
-	for len(queue) != 0 {
-		path := queue[0]
-		queue = queue[1:]
-
-		item := root.GetByPath(path...)
-		filetype, _ := item.Get("type").String()
-		switch filetype {
-		case "directory":
-			items, _ := item.Get("entries").Map()
-			for key := range items {
-				newPath := make([]interface{}, len(path), len(path)+2)
-				copy(newPath, path)
-				newPath = append(newPath, "entries", key)
-				queue = append(queue, newPath)
-			}
-
-			continue
-
-		case "regular":
-			filepath := ""
-			for _, elem := range path {
-				if elem != "entries" {
-					filepath += "/" + elem.(string)
-				}
-			}
-
-			result = append(result, filepath[5:]) // NOTE: We are cutting /root from the filepath
-			continue
-		}
+// FetchNarInfo fetches the narinfo of the store path from a binary cache, the errors are the same as the ones of FetchListing.
+func (sp StorePath) FetchNarInfo(ctx context.Context, url string, cli *http.Client) (*NarInfo, error) {
+	resp, err := get(ctx, cli, fmt.Sprintf("%s/%s.narinfo", url, sp.Hash()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCacheUnavailable, err)
+	}
+
+	info, err := ParseNarInfo(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.StorePath != sp {
+		return nil, fmt.Errorf("%w: describes %s instead of %s", ErrBadNarInfo, info.StorePath, sp)
+	}
+
+	return info, nil
+}
+
+// get requests a file from a binary cache and checks the response status, the caller has to close the body.
+func get(ctx context.Context, cli *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := cli.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCacheUnavailable, err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return resp, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		err = fmt.Errorf("%w: %s", ErrListingNotFound, url)
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		err = fmt.Errorf("%w: %s responded with %s", ErrCacheUnavailable, url, resp.Status)
+	default:
+		err = fmt.Errorf("unexpected response from %s: %s", url, resp.Status)
 	}
 
-	return result
+	resp.Body.Close()
+	return nil, err
 }
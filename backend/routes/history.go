@@ -1,21 +1,32 @@
 package routes
 
 import (
+	"errors"
 	"net/http"
 
+	"github.com/TypicalAM/nix-hund/db"
 	"github.com/TypicalAM/nix-hund/metrics"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
 )
 
-// HistoryList returns the history of the user.
+// HistoryList returns a page of the history of the user.
 func (cntr *Controller) HistoryList(c echo.Context) error {
 	metrics.RequestCount.Inc()
 
+	page, err := pageRequest(c)
+	if err != nil {
+		return err
+	}
+
 	token := c.Get("user").(*jwt.Token)
 	claims := token.Claims.(*JwtUserClaims)
-	list, err := cntr.dbase.History(claims.Name)
+	list, err := cntr.dbase.History(claims.Name, page)
 	if err != nil {
+		if errors.Is(err, db.ErrBadCursor) || errors.Is(err, db.ErrBadSort) {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
 		return err
 	}
 
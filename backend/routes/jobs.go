@@ -0,0 +1,577 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/TypicalAM/nix-hund/db"
+	"github.com/TypicalAM/nix-hund/metrics"
+	"github.com/TypicalAM/nix-hund/nixpkgs"
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// JobState is the state of an index generation job.
+type JobState string
+
+const (
+	JobQueued  JobState = "queued"
+	JobRunning JobState = "running"
+	JobDone    JobState = "done"
+	JobFailed  JobState = "failed"
+)
+
+// jobRetention is how long finished and cancelled jobs can still be looked up.
+const jobRetention = 24 * time.Hour
+
+var errJobCancelled = errors.New("cancelled")
+
+// Job is an index generation job running in the background.
+type Job struct {
+	ID        string        `json:"id"`
+	IndexID   string        `json:"index_id"`
+	Channel   string        `json:"channel"`
+	System    string        `json:"system,omitempty"`
+	Outputs   []string      `json:"outputs"`
+	Verify    db.VerifyMode `json:"verify"`
+	State     JobState      `json:"state"`
+	Processed int           `json:"processed_outputs"`
+	Total     int           `json:"total_outputs"`
+	Reused    int           `json:"reused_outputs"`
+	Fetched   int           `json:"fetched_outputs"`
+	Failed    int           `json:"failed_outputs"`
+	FileCount int           `json:"total_file_count"`
+	Retry     bool          `json:"retry,omitempty"` // Re-fetches the failed outputs of an existing index
+	Error     string        `json:"error,omitempty"`
+	Created   time.Time     `json:"created"`
+	Started   *time.Time    `json:"started,omitempty"`
+	Finished  *time.Time    `json:"finished,omitempty"`
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// finished reports if the job has reached a final state.
+func (job *Job) finished() bool {
+	return job.State == JobDone || job.State == JobFailed
+}
+
+// jobQueue keeps track of the index jobs and feeds them to the worker.
+type jobQueue struct {
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	queue chan *Job
+}
+
+// newJobQueue creates an empty job queue.
+func newJobQueue() *jobQueue {
+	return &jobQueue{
+		jobs:  make(map[string]*Job),
+		queue: make(chan *Job, 64),
+	}
+}
+
+// add registers a new queued job which indexes a channel.
+func (q *jobQueue) add(channel nixpkgs.Channel, outputs nixpkgs.OutputFilter, verify db.VerifyMode) (Job, error) {
+	return q.enqueue(&Job{IndexID: uuid.New().String(), Channel: channel.Name, System: channel.System, Outputs: outputs, Verify: verify})
+}
+
+// addRetry registers a new queued job which re-fetches the failed outputs of an index, using the verification mode of the index.
+func (q *jobQueue) addRetry(indexID, channel string, verify db.VerifyMode) (Job, error) {
+	return q.enqueue(&Job{IndexID: indexID, Channel: channel, Verify: verify, Retry: true})
+}
+
+// enqueue queues the job and starts tracking it.
+func (q *jobQueue) enqueue(job *Job) (Job, error) {
+	job.ID = uuid.New().String()
+	job.State = JobQueued
+	job.Created = time.Now()
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune(job.Created)
+
+	select {
+	case q.queue <- job:
+	default:
+		job.cancel()
+		return Job{}, errors.New("too many queued jobs")
+	}
+
+	q.jobs[job.ID] = job
+	return *job, nil
+}
+
+// prune forgets the jobs which finished more than the retention period ago, the caller holds the lock.
+func (q *jobQueue) prune(now time.Time) {
+	for id, job := range q.jobs {
+		if job.finished() && now.Sub(*job.Finished) > jobRetention {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// get returns a snapshot of the job.
+func (q *jobQueue) get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+
+	return *job, true
+}
+
+// update modifies the job under the lock.
+func (q *jobQueue) update(id string, fn func(job *Job)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if job, ok := q.jobs[id]; ok {
+		fn(job)
+	}
+}
+
+// cancel cancels an unfinished job, queued jobs are failed right away.
+func (q *jobQueue) cancel(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, errors.New("no such job")
+	}
+
+	if job.finished() {
+		return *job, errors.New("job already finished")
+	}
+
+	job.cancel()
+	if job.State == JobQueued {
+		now := time.Now()
+		job.State = JobFailed
+		job.Error = errJobCancelled.Error()
+		job.Finished = &now
+	}
+
+	return *job, nil
+}
+
+// start marks the job as running.
+func (q *jobQueue) start(id string) time.Time {
+	now := time.Now()
+	q.update(id, func(job *Job) {
+		job.State = JobRunning
+		job.Started = &now
+	})
+
+	return now
+}
+
+// finish puts the job into a final state depending on the error.
+func (q *jobQueue) finish(id string, err error) {
+	q.update(id, func(job *Job) {
+		now := time.Now()
+		job.Finished = &now
+		job.cancel()
+
+		if err != nil {
+			job.State = JobFailed
+			job.Error = err.Error()
+			return
+		}
+
+		job.State = JobDone
+	})
+}
+
+// indexWorker runs the queued index jobs one by one.
+func (cntr *Controller) indexWorker() {
+	for job := range cntr.jobs.queue {
+		if job.ctx.Err() != nil {
+			continue // Cancelled while still in the queue
+		}
+
+		var err error
+		if job.Retry {
+			err = cntr.retryIndex(job.ctx, job.ID, job.IndexID, job.Verify)
+		} else {
+			err = cntr.generateIndex(job.ctx, job.ID, job.IndexID, job.Channel, job.System, job.Outputs, job.Verify)
+		}
+
+		if err != nil {
+			if job.ctx.Err() != nil {
+				err = errJobCancelled
+			}
+
+			log.Error("Indexing failed", "job", job.ID, "channel", job.Channel, "err", err)
+			if !job.Retry { // A retried index stays usable, the outputs which weren't retried are still recorded as failed
+				if err := cntr.dbase.DeleteIndex(job.IndexID); err != nil {
+					log.Error("Cleaning up the index failed", "index", job.IndexID, "err", err)
+				}
+			}
+		}
+
+		cntr.jobs.finish(job.ID, err)
+	}
+}
+
+// generateIndex fetches and inserts the listings of a channel into a new index, reporting progress to the job.
+func (cntr *Controller) generateIndex(ctx context.Context, jobID, id, channel, system string, filter nixpkgs.OutputFilter, verify db.VerifyMode) error {
+	indexTime := cntr.jobs.start(jobID)
+
+	pkgs, err := nixpkgs.New(cntr.source, channel, cntr.cacheDir)
+	if err != nil {
+		return err
+	}
+	pkgs.Workers = cntr.workers
+
+	outputs := pkgs.Outputs(filter)
+	cntr.jobs.update(jobID, func(job *Job) { job.Total = len(outputs) })
+
+	prog, err := cntr.indexOutputs(ctx, jobID, id, pkgs, outputs, verify, false)
+	if err != nil {
+		return err
+	}
+
+	if err := cntr.dbase.InsertIndex(indexTime, channel, system, id, filter, verify); err != nil {
+		return err
+	}
+
+	log.Info("Indexing done", "time taken", time.Since(indexTime), "reused", prog.reused, "fetched", prog.fetched, "failed", prog.failed)
+	return nil
+}
+
+// retryIndex fetches the failed outputs of an existing index again, reporting progress to the job.
+func (cntr *Controller) retryIndex(ctx context.Context, jobID, id string, verify db.VerifyMode) error {
+	retryTime := cntr.jobs.start(jobID)
+
+	failures, err := cntr.dbase.FailedOutputs(id)
+	if err != nil {
+		return err
+	}
+
+	outputs := make([]nixpkgs.Output, len(failures))
+	for i, failure := range failures {
+		outputs[i] = nixpkgs.Output{
+			PkgName: failure.PkgName,
+			Name:    failure.Outname,
+			Version: failure.Version,
+			Path:    nixpkgs.StorePath("/nix/store/" + failure.Outhash + "-" + failure.StoreName),
+		}
+	}
+	cntr.jobs.update(jobID, func(job *Job) { job.Total = len(outputs) })
+
+	// The channel file isn't needed, the failures have everything required to fetch the listings
+	pkgs := &nixpkgs.Pkgs{Source: cntr.source, Workers: cntr.workers}
+	prog, err := cntr.indexOutputs(ctx, jobID, id, pkgs, outputs, verify, true)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Retry done", "index", id, "time taken", time.Since(retryTime), "reused", prog.reused, "fetched", prog.fetched, "failed", prog.failed)
+	return nil
+}
+
+// progress counts the outputs handled by a job.
+type progress struct {
+	processed int
+	reused    int
+	fetched   int
+	failed    int
+	files     int
+}
+
+// report copies the counts to the job.
+func (prog progress) report(job *Job) {
+	job.Processed = prog.processed
+	job.Reused = prog.reused
+	job.Fetched = prog.fetched
+	job.Failed = prog.failed
+	job.FileCount = prog.files
+}
+
+// indexOutputs adds the outputs to the index, reusing the already stored outputs and fetching the rest.
+// Outputs which can't be fetched or fail the strict verification are recorded as failures, when retrying the old failures of the
+// indexed outputs are removed.
+func (cntr *Controller) indexOutputs(ctx context.Context, jobID, id string, pkgs *nixpkgs.Pkgs, outputs []nixpkgs.Output, verify db.VerifyMode, retry bool) (progress, error) {
+	prog := progress{}
+	known, err := cntr.dbase.KnownOutputs()
+	if err != nil {
+		return prog, err
+	}
+
+	// indexed is called after an output was added to the index
+	indexed := func(name, hash string) error {
+		if !retry {
+			return nil
+		}
+
+		return cntr.dbase.DeleteFailure(id, name, hash)
+	}
+
+	// failed records the output instead of indexing it without files
+	failed := func(output nixpkgs.Output, reason error) error {
+		if err := cntr.dbase.InsertFailure(id, output.PkgName, output.Name, output.Path.Hash(), output.Path.Name(), output.Version, reason.Error()); err != nil {
+			log.Error("Recording the failure failed", "name", output.PkgName, "err", err)
+			return errors.New("indexing failed at: " + output.PkgName)
+		}
+
+		prog.processed++
+		prog.failed++
+		cntr.jobs.update(jobID, prog.report)
+
+		metrics.FailedOutputsCount.Inc()
+		return nil
+	}
+
+	// Outputs stored without the narinfo only need the narinfo, their files are already known
+	noInfo := make([]nixpkgs.Output, 0)
+	for _, output := range outputs {
+		if hasInfo, ok := known[output.Path.Hash()]; ok && !hasInfo {
+			noInfo = append(noInfo, output)
+		}
+	}
+
+	if err := cntr.backfillNarInfo(ctx, pkgs, noInfo); err != nil {
+		return prog, err
+	}
+
+	// Outputs stored for an earlier index have the same files, there is no need to fetch them again
+	missing := make([]nixpkgs.Output, 0)
+	for _, output := range outputs {
+		if ctx.Err() != nil {
+			return prog, ctx.Err()
+		}
+
+		if _, ok := known[output.Path.Hash()]; !ok {
+			missing = append(missing, output)
+			continue
+		}
+
+		verified := false
+		if verify != db.VerifyOff {
+			info, err := cntr.dbase.StoredOutputInfo(output.Path.Hash())
+			if err != nil {
+				return prog, err
+			}
+
+			verified, err = cntr.verifyOutput(narInfo(output.Path, info), verify)
+			if err != nil {
+				if err := failed(output, err); err != nil {
+					return prog, err
+				}
+				continue
+			}
+		}
+
+		count, err := cntr.dbase.LinkPkg(id, output.PkgName, output.Name, output.Path.Hash(), output.Path.Name(), output.Version, verified)
+		if err == nil {
+			err = indexed(output.PkgName, output.Path.Hash())
+		}
+		if err != nil {
+			log.Error("Indexing failed", "name", output.PkgName, "err", err)
+			return prog, errors.New("indexing failed at: " + output.PkgName)
+		}
+
+		prog.files += count
+		prog.processed++
+		prog.reused++
+		cntr.jobs.update(jobID, prog.report)
+
+		metrics.ProcessedOutputsCount.Inc()
+	}
+
+	log.Info("Reused outputs from earlier indices", "reused", prog.reused, "to_fetch", len(missing))
+
+	// The fetchers are stopped when inserting fails, the listings already in the pipeline are drained
+	fetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var insertErr error
+	for listing := range pkgs.ProcessListings(pkgs.FetchListings(fetchCtx, missing)) {
+		if ctx.Err() != nil || insertErr != nil {
+			continue // Drain the pipeline so that the fetchers can exit
+		}
+
+		output := nixpkgs.Output{
+			PkgName: listing.PkgName,
+			Name:    listing.OutputName,
+			Version: listing.Version,
+			Path:    nixpkgs.StorePath("/nix/store/" + listing.OutputHash + "-" + listing.StoreName),
+		}
+
+		verified := false
+		err := listing.Err
+		if err == nil {
+			verified, err = cntr.verifyOutput(listing.NarInfo, verify)
+		}
+
+		if err != nil {
+			if insertErr = failed(output, err); insertErr != nil {
+				cancel()
+			}
+			continue
+		}
+
+		err = cntr.dbase.InsertPkg(id, listing.PkgName, listing.OutputName, listing.OutputHash, listing.StoreName, listing.Version, listing.Cache, verified,
+			dbFiles(listing.Files), outputInfo(listing.NarInfo))
+		if err == nil {
+			err = indexed(listing.PkgName, listing.OutputHash)
+		}
+		if err != nil {
+			log.Error("Indexing failed", "name", listing.PkgName, "err", err)
+			insertErr = errors.New("indexing failed at: " + listing.PkgName)
+			cancel()
+			continue
+		}
+
+		prog.files += len(listing.Files)
+		prog.processed++
+		prog.fetched++
+		cntr.jobs.update(jobID, prog.report)
+
+		metrics.ProcessedOutputsCount.Inc()
+		log.Info("Package",
+			"name", listing.PkgName,
+			"outname", listing.OutputName,
+			"size", len(listing.Files),
+			"verified", verified,
+			"total_packages", prog.processed,
+			"total_files", prog.files,
+		)
+	}
+
+	if insertErr != nil {
+		return prog, insertErr
+	}
+
+	return prog, ctx.Err()
+}
+
+// backfillNarInfo fetches and stores the narinfo of reused outputs which were stored without it, so that they can be verified and
+// their references can be followed by the reverse dependency queries. Outputs whose narinfo can't be fetched are kept without it
+// and count as unverified.
+func (cntr *Controller) backfillNarInfo(ctx context.Context, pkgs *nixpkgs.Pkgs, outputs []nixpkgs.Output) error {
+	if len(outputs) == 0 {
+		return nil
+	}
+
+	stored := 0
+	for fetched := range pkgs.FetchNarInfos(ctx, outputs) {
+		if fetched.Err != nil {
+			log.Debug("Fetching the narinfo of a reused output failed", "name", fetched.Output.PkgName, "err", fetched.Err)
+			continue
+		}
+
+		if err := cntr.dbase.StoreOutputInfo(fetched.Output.Path.Hash(), outputInfo(fetched.NarInfo)); err != nil {
+			log.Error("Storing the narinfo failed", "name", fetched.Output.PkgName, "err", err)
+			continue
+		}
+		stored++
+	}
+
+	log.Info("Stored the narinfo of reused outputs", "stored", stored, "missing", len(outputs)-stored)
+	return ctx.Err()
+}
+
+// verifyOutput checks the signatures of the narinfo against the trusted keys. Unverified outputs are only an error in the strict mode,
+// otherwise they are just marked as unverified.
+func (cntr *Controller) verifyOutput(info *nixpkgs.NarInfo, verify db.VerifyMode) (bool, error) {
+	if verify == db.VerifyOff {
+		return false, nil
+	}
+
+	err := nixpkgs.ErrUnverified
+	if info != nil {
+		err = info.Verify(cntr.trustedKeys)
+	}
+
+	if err != nil && verify == db.VerifyStrict {
+		return false, err
+	}
+
+	return err == nil, nil
+}
+
+// dbFiles converts the files of a listing for insertion.
+func dbFiles(files []nixpkgs.File) []db.File {
+	result := make([]db.File, len(files))
+	for i, file := range files {
+		result[i] = db.File(file)
+	}
+
+	return result
+}
+
+// outputInfo converts the narinfo of a listing for insertion.
+func outputInfo(info *nixpkgs.NarInfo) *db.OutputInfo {
+	if info == nil {
+		return nil
+	}
+
+	return &db.OutputInfo{
+		NarHash:     info.NarHash,
+		NarSize:     info.NarSize,
+		FileSize:    info.FileSize,
+		References:  info.References,
+		Deriver:     info.Deriver,
+		Compression: info.Compression,
+		Sigs:        info.Sig,
+	}
+}
+
+// narInfo converts the stored metadata of an output back to a narinfo for verification.
+func narInfo(sp nixpkgs.StorePath, info *db.OutputInfo) *nixpkgs.NarInfo {
+	if info == nil {
+		return nil
+	}
+
+	return &nixpkgs.NarInfo{
+		StorePath:   sp,
+		Compression: info.Compression,
+		FileSize:    info.FileSize,
+		NarHash:     info.NarHash,
+		NarSize:     info.NarSize,
+		References:  info.References,
+		Deriver:     info.Deriver,
+		Sig:         info.Sigs,
+	}
+}
+
+// IndexJob returns the status of an index generation job.
+func (cntr *Controller) IndexJob(c echo.Context) error {
+	metrics.RequestCount.Inc()
+
+	job, ok := cntr.jobs.get(c.Param("id"))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "No such job")
+	}
+
+	return c.JSON(http.StatusOK, job)
+}
+
+// IndexJobCancel cancels an index generation job.
+func (cntr *Controller) IndexJobCancel(c echo.Context) error {
+	metrics.RequestCount.Inc()
+
+	id := c.Param("id")
+	if _, ok := cntr.jobs.get(id); !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "No such job")
+	}
+
+	job, err := cntr.jobs.cancel(id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusConflict, "Couldn't cancel job: "+err.Error())
+	}
+
+	log.Info("Cancelled index job", "job", id, "channel", job.Channel)
+	return c.JSON(http.StatusOK, job)
+}
@@ -1,57 +1,72 @@
 package routes
 
 import (
+	"errors"
 	"net/http"
-	"slices"
-	"time"
+	"strconv"
+	"strings"
 
+	"github.com/TypicalAM/nix-hund/db"
 	"github.com/TypicalAM/nix-hund/metrics"
 	"github.com/TypicalAM/nix-hund/nixpkgs"
 	"github.com/charmbracelet/log"
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/google/uuid"
 	"github.com/labstack/echo/v4"
 )
 
-// ChannelList lists the available channels.
+// ChannelList lists the available channels with their metadata. The names are also listed on their own for the older clients.
 type ChannelList struct {
-	Channels []string `json:"channels"`
+	Channels []string          `json:"channels"`
+	Details  []nixpkgs.Channel `json:"details"`
 }
 
-// ChannelList lists the available channels.
+// ChannelList lists the available channels, optionally only the ones fetched for a system.
 func (cntr *Controller) ChannelList(c echo.Context) error {
-	return c.JSON(http.StatusOK, ChannelList{Channels: cntr.channels})
+	system := c.QueryParam("system")
+	list := ChannelList{Channels: make([]string, 0), Details: make([]nixpkgs.Channel, 0)}
+	for _, channel := range cntr.channelList() {
+		if system == "" || channel.System == system {
+			list.Channels = append(list.Channels, channel.Name)
+			list.Details = append(list.Details, channel)
+		}
+	}
+
+	return c.JSON(http.StatusOK, list)
 }
 
-// IndexList returns indices made on this channel.
+// IndexList returns a page of indices made on this channel, optionally only the ones made for a system.
 func (cntr *Controller) IndexList(c echo.Context) error {
 	channel := c.QueryParam("channel")
 	if channel == "" {
 		return echo.NewHTTPError(http.StatusBadRequest, "No channel specified")
 	}
 
-	list, err := cntr.dbase.ListIndices(channel)
+	page, err := pageRequest(c)
+	if err != nil {
+		return err
+	}
+
+	list, err := cntr.dbase.ListIndices(channel, c.QueryParam("system"), page)
 	if err != nil {
+		if errors.Is(err, db.ErrBadCursor) || errors.Is(err, db.ErrBadSort) {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
 		return echo.NewHTTPError(http.StatusInternalServerError, "Error while listing indices: "+err.Error())
 	}
 
 	return c.JSON(http.StatusOK, list)
 }
 
-// IndexGenerateInput specifies the channel that we want to use.
+// IndexGenerateInput specifies the channel that we want to use and the names of the outputs which should be indexed.
+// The outputs default to ["dev"], use ["*"] to index every output. The signature verification is one of off, flag (default) or strict.
 type IndexGenerateInput struct {
-	Channel string `json:"channel"`
-}
-
-// IndexGenreateResult is the result information about the freshly generated index.
-type IndexGenreateResult struct {
-	ID                string        `json:"id"`
-	Time              time.Duration `json:"time"`
-	TotalPackageCount int           `json:"total_package_count"`
-	TotalFilecount    int           `json:"total_file_count"`
+	Channel string        `json:"channel"`
+	Outputs []string      `json:"outputs"`
+	Verify  db.VerifyMode `json:"verify"`
 }
 
-// IndexGenerate creates an index for a channel.
+// IndexGenerate queues the creation of an index for a channel, the progress can be followed using the returned job.
 func (cntr *Controller) IndexGenerate(c echo.Context) error {
 	metrics.RequestCount.Inc()
 	metrics.IndexCount.Inc()
@@ -62,52 +77,43 @@ func (cntr *Controller) IndexGenerate(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	if !slices.Contains(cntr.channels, input.Channel) {
+	channel, ok := cntr.channel(input.Channel)
+	if !ok {
 		log.Error("Asked for a bad channel", "channel", input.Channel)
 		return echo.NewHTTPError(http.StatusBadRequest, "This channel isn't parsed, use /channel to get the available channels")
 	}
 
-	pkgs, err := nixpkgs.New(cntr.cacheURL, input.Channel, cntr.cacheDir)
+	filter := nixpkgs.DefaultOutputFilter
+	if len(input.Outputs) != 0 {
+		filter = input.Outputs
+	}
+
+	for _, outname := range filter {
+		if outname == "" || strings.Contains(outname, ",") {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid output name: "+outname)
+		}
+	}
+
+	verify := input.Verify
+	if verify == "" {
+		verify = db.VerifyFlag
+	}
+
+	if !verify.Valid() {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown verification mode, use off, flag or strict")
+	}
+
+	job, err := cntr.jobs.add(channel, filter, verify)
 	if err != nil {
-		log.Error("Indexing failed", "channel", input.Channel, "err", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "Getting lists failed: "+err.Error())
-	}
-
-	indexTime := time.Now()
-	totalFileCount := 0
-	totalPkgs := 0
-	id := uuid.New().String()
-
-	for listing := range pkgs.ProcessListings(pkgs.FetchListings(pkgs.CountDev())) {
-		if err := cntr.dbase.InsertPkg(indexTime, input.Channel, id, listing.PkgName, listing.OutputName, listing.OutputHash, listing.Version, listing.Files); err != nil {
-			log.Error("Indexing failed", "name", listing.PkgName, "err", err)
-			return echo.NewHTTPError(http.StatusInternalServerError, "Indexing failed at: "+listing.PkgName)
-		}
-
-		totalFileCount += len(listing.Files)
-		totalPkgs++
-
-		metrics.ProcessedOutputsCount.Inc()
-		log.Info("Package",
-			"name", listing.PkgName,
-			"outname", listing.OutputName,
-			"size", len(listing.Files),
-			"total_packages", totalPkgs,
-			"total_files", totalFileCount,
-		)
-	}
-
-	end := time.Now().Sub(indexTime)
-	log.Info("Indexing done", "time taken", end)
-	return c.JSON(http.StatusOK, IndexGenreateResult{
-		ID:                id,
-		Time:              end,
-		TotalFilecount:    totalFileCount,
-		TotalPackageCount: totalPkgs,
-	})
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Couldn't queue the index: "+err.Error())
+	}
+
+	log.Info("Queued index job", "job", job.ID, "channel", input.Channel, "system", channel.System, "outputs", filter, "verify", verify)
+	return c.JSON(http.StatusAccepted, job)
 }
 
-// Query queries an index for a package.
+// Query queries an index for a package, the mode query param selects exact, glob, substring or regex matching.
+// The optional system query param has to match the system of the index.
 func (cntr *Controller) IndexQuery(c echo.Context) error {
 	metrics.RequestCount.Inc()
 
@@ -121,20 +127,190 @@ func (cntr *Controller) IndexQuery(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "No index id")
 	}
 
-	res, err := cntr.dbase.QueryPkg(id, query)
+	if system := c.QueryParam("system"); system != "" {
+		indexSystem, err := cntr.dbase.IndexSystem(id)
+		if err != nil {
+			if errors.Is(err, db.ErrNoIndex) {
+				return echo.NewHTTPError(http.StatusNotFound, "No such index")
+			}
+
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error while reading the index: "+err.Error())
+		}
+
+		if indexSystem != system {
+			return echo.NewHTTPError(http.StatusBadRequest, "The index was made for "+indexSystem+", not "+system)
+		}
+	}
+
+	page, err := pageRequest(c)
+	if err != nil {
+		return err
+	}
+
+	mode := db.QueryMode(c.QueryParam("mode"))
+	res, err := cntr.dbase.QueryPkg(id, query, mode, page)
 	if err != nil {
+		if errors.Is(err, db.ErrBadCursor) || errors.Is(err, db.ErrBadSort) {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		if errors.Is(err, db.ErrBadMode) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Unknown mode, use exact, glob, substring or regex")
+		}
+
+		if errors.Is(err, db.ErrBadPattern) {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		if errors.Is(err, db.ErrQueryTimeout) {
+			return echo.NewHTTPError(http.StatusRequestTimeout, "The query took too long, try a more specific pattern")
+		}
+
 		return echo.NewHTTPError(http.StatusInternalServerError, "Error while fetching: "+err.Error())
 	}
 
-	if len(res) == 0 {
+	if len(res.Items) == 0 || page.Cursor != "" {
 		return c.JSON(http.StatusOK, res)
 	}
 
 	token := c.Get("user").(*jwt.Token)
 	claims := token.Claims.(*JwtUserClaims)
-	if err := cntr.dbase.HistoryAdd(id, claims.Name, res[0]); err != nil { // TODO: Saving only the first result
+	if err := cntr.dbase.HistoryAdd(id, claims.Name, res.Items[0]); err != nil { // TODO: Saving only the first result
 		return echo.NewHTTPError(http.StatusInternalServerError, "Error while adding history entry: "+err.Error())
 	}
 
 	return c.JSON(http.StatusOK, res)
 }
+
+// IndexFailures returns a page of the outputs of an index whose listings couldn't be fetched.
+func (cntr *Controller) IndexFailures(c echo.Context) error {
+	metrics.RequestCount.Inc()
+
+	id := c.Param("id")
+	if _, _, err := cntr.dbase.IndexSettings(id); err != nil {
+		if errors.Is(err, db.ErrNoIndex) {
+			return echo.NewHTTPError(http.StatusNotFound, "No such index")
+		}
+
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error while reading the index: "+err.Error())
+	}
+
+	page, err := pageRequest(c)
+	if err != nil {
+		return err
+	}
+
+	failures, err := cntr.dbase.Failures(id, page)
+	if err != nil {
+		if errors.Is(err, db.ErrBadCursor) || errors.Is(err, db.ErrBadSort) {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error while listing failures: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, failures)
+}
+
+// IndexReverseDeps returns a page of the indexed outputs which reference an output, the hash may also be given as a store path.
+// The references are followed up to the depth (default 5).
+func (cntr *Controller) IndexReverseDeps(c echo.Context) error {
+	metrics.RequestCount.Inc()
+
+	hash := c.QueryParam("hash")
+	if strings.HasPrefix(hash, "/nix/store/") {
+		hash = nixpkgs.StorePath(hash).Hash()
+	}
+
+	if hash == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "No hash param")
+	}
+
+	depth := db.DefaultRdepsDepth
+	if param := c.QueryParam("depth"); param != "" {
+		parsed, err := strconv.Atoi(param)
+		if err != nil || parsed <= 0 || parsed > db.MaxRdepsDepth {
+			return echo.NewHTTPError(http.StatusBadRequest, "The depth has to be a number between 1 and "+strconv.Itoa(db.MaxRdepsDepth))
+		}
+		depth = parsed
+	}
+
+	id := c.Param("id")
+	if _, _, err := cntr.dbase.IndexSettings(id); err != nil {
+		if errors.Is(err, db.ErrNoIndex) {
+			return echo.NewHTTPError(http.StatusNotFound, "No such index")
+		}
+
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error while reading the index: "+err.Error())
+	}
+
+	page, err := pageRequest(c)
+	if err != nil {
+		return err
+	}
+
+	deps, err := cntr.dbase.ReverseDeps(id, hash, depth, page)
+	if err != nil {
+		if errors.Is(err, db.ErrBadCursor) || errors.Is(err, db.ErrBadSort) {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		if errors.Is(err, db.ErrQueryTimeout) {
+			return echo.NewHTTPError(http.StatusRequestTimeout, "The query took too long, try a smaller depth")
+		}
+
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error while listing reverse dependencies: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, deps)
+}
+
+// IndexRetry queues a job which fetches the failed outputs of an index again and adds them to the same index.
+func (cntr *Controller) IndexRetry(c echo.Context) error {
+	metrics.RequestCount.Inc()
+
+	id := c.Param("id")
+	channel, verify, err := cntr.dbase.IndexSettings(id)
+	if err != nil {
+		if errors.Is(err, db.ErrNoIndex) {
+			return echo.NewHTTPError(http.StatusNotFound, "No such index")
+		}
+
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error while reading the index: "+err.Error())
+	}
+
+	failures, err := cntr.dbase.Failures(id, db.PageRequest{Limit: 1})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error while listing failures: "+err.Error())
+	}
+
+	if failures.Total == 0 {
+		return echo.NewHTTPError(http.StatusConflict, "The index has no failed outputs")
+	}
+
+	job, err := cntr.jobs.addRetry(id, channel, verify)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Couldn't queue the retry: "+err.Error())
+	}
+
+	log.Info("Queued retry job", "job", job.ID, "index", id, "failures", failures.Total)
+	return c.JSON(http.StatusAccepted, job)
+}
+
+// pageRequest reads the pagination query params: limit, cursor and sort.
+func pageRequest(c echo.Context) (db.PageRequest, error) {
+	page := db.PageRequest{
+		Cursor: c.QueryParam("cursor"),
+		Sort:   c.QueryParam("sort"),
+	}
+
+	if limit := c.QueryParam("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed <= 0 {
+			return page, echo.NewHTTPError(http.StatusBadRequest, "The limit has to be a positive number")
+		}
+		page.Limit = parsed
+	}
+
+	return page, nil
+}
@@ -0,0 +1,98 @@
+package routes
+
+import (
+	"fmt"
+
+	"github.com/TypicalAM/nix-hund/db"
+	"github.com/TypicalAM/nix-hund/metrics"
+	"github.com/TypicalAM/nix-hund/nixpkgs"
+	"github.com/charmbracelet/log"
+	"github.com/robfig/cron/v3"
+)
+
+// StartRefresh re-fetches the channels on a cron schedule, for example "0 4 * * *" or "@daily", and reloads the channel list.
+// With autoIndex a channel whose content changed is indexed again using the settings of its newest index.
+// A refresh which is still running when the next one is due makes the next one skip.
+func (cntr *Controller) StartRefresh(schedule string, channels []nixpkgs.ChannelSource, autoIndex bool) error {
+	dir, err := nixpkgs.ChannelsDir(cntr.cacheDir)
+	if err != nil {
+		return err
+	}
+
+	sched := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DiscardLogger)))
+	if _, err := sched.AddFunc(schedule, func() { cntr.refreshChannels(dir, channels, autoIndex) }); err != nil {
+		return fmt.Errorf("invalid refresh schedule %q: %w", schedule, err)
+	}
+
+	sched.Start()
+	log.Info("Scheduled channel refresh", "schedule", schedule, "channels", len(channels), "auto_index", autoIndex)
+	return nil
+}
+
+// refreshChannels fetches the channels one by one, a failed fetch keeps the old channel file.
+func (cntr *Controller) refreshChannels(dir string, channels []nixpkgs.ChannelSource, autoIndex bool) {
+	changed := make([]string, 0)
+	for _, channel := range channels {
+		log.Info("Refreshing channel", "name", channel.Name, "source", channel.Source, "system", channel.System)
+		hash, ok, err := nixpkgs.RefreshChannel(channel.Source, channel.System, dir+"/"+channel.Name+".json")
+		if err != nil {
+			log.Error("Refreshing the channel failed", "name", channel.Name, "err", err)
+			continue
+		}
+
+		if !ok {
+			log.Info("Channel is unchanged", "name", channel.Name, "hash", hash)
+			continue
+		}
+
+		changed = append(changed, channel.Name)
+	}
+
+	if len(changed) == 0 {
+		return
+	}
+
+	if err := cntr.reloadChannels(); err != nil {
+		log.Error("Reloading the channels failed", "err", err)
+		return
+	}
+
+	if !autoIndex {
+		return
+	}
+
+	for _, name := range changed {
+		if err := cntr.autoIndex(name); err != nil {
+			log.Error("Queueing the index of the refreshed channel failed", "name", name, "err", err)
+		}
+	}
+}
+
+// autoIndex queues an index of the channel with the output filter and the verification mode of its newest index.
+func (cntr *Controller) autoIndex(name string) error {
+	channel, ok := cntr.channel(name)
+	if !ok {
+		return fmt.Errorf("channel %s isn't available", name)
+	}
+
+	filter := nixpkgs.DefaultOutputFilter
+	verify := db.VerifyFlag
+	latest, err := cntr.dbase.ListIndices(channel.Name, channel.System, db.PageRequest{Limit: 1})
+	if err != nil {
+		return err
+	}
+
+	if len(latest.Items) != 0 {
+		filter = latest.Items[0].Outputs
+		verify = latest.Items[0].Verify
+	}
+
+	job, err := cntr.jobs.add(channel, filter, verify)
+	if err != nil {
+		return err
+	}
+
+	metrics.IndexCount.Inc()
+	log.Info("Queued index job for the refreshed channel", "job", job.ID, "channel", channel.Name, "system", channel.System, "outputs", filter, "verify", verify)
+	return nil
+}
@@ -1,23 +1,83 @@
 package routes
 
 import (
+	"sync"
+
 	"github.com/TypicalAM/nix-hund/db"
+	"github.com/TypicalAM/nix-hund/metrics"
+	"github.com/TypicalAM/nix-hund/nixpkgs"
 )
 
 // Controller manages the routes.
 type Controller struct {
-	cacheURL string
-	dbase    *db.DB
-	channels []string
-	cacheDir string
+	source      nixpkgs.Source
+	trustedKeys []nixpkgs.PublicKey
+	dbase       *db.DB
+	channelsMu  sync.RWMutex // Guards the channels, which are reloaded while serving
+	channels    []nixpkgs.Channel
+	cacheDir    string
+	workers     int
+	jobs        *jobQueue
 }
 
 // New creates a new controller.
-func New(cacheURL string, database *db.DB, channels []string, cacheDir string) (*Controller, error) {
-	return &Controller{
-		cacheURL: cacheURL,
-		dbase:    database,
-		channels: channels,
-		cacheDir: cacheDir,
-	}, nil
+func New(source nixpkgs.Source, trustedKeys []nixpkgs.PublicKey, database *db.DB, channels []nixpkgs.Channel, cacheDir string, fetchWorkers int) (*Controller, error) {
+	cntr := &Controller{
+		source:      source,
+		trustedKeys: trustedKeys,
+		dbase:       database,
+		channels:    channels,
+		cacheDir:    cacheDir,
+		workers:     fetchWorkers,
+		jobs:        newJobQueue(),
+	}
+
+	setChannelMetrics(channels)
+	go cntr.indexWorker()
+	return cntr, nil
+}
+
+// channelList returns the available channels. The list is replaced on reload and never modified, so it can be used after unlocking.
+func (cntr *Controller) channelList() []nixpkgs.Channel {
+	cntr.channelsMu.RLock()
+	defer cntr.channelsMu.RUnlock()
+	return cntr.channels
+}
+
+// reloadChannels reads the available channels again and replaces the channel list.
+func (cntr *Controller) reloadChannels() error {
+	channels, err := nixpkgs.AvailableChannels(cntr.cacheDir)
+	if err != nil {
+		return err
+	}
+
+	cntr.channelsMu.Lock()
+	cntr.channels = channels
+	cntr.channelsMu.Unlock()
+
+	setChannelMetrics(channels)
+	return nil
+}
+
+// setChannelMetrics exports the metadata of the available channels, the removed channels disappear from the metrics.
+func setChannelMetrics(channels []nixpkgs.Channel) {
+	metrics.NixpkgsDate.Reset()
+	metrics.ChannelPackageCount.Reset()
+	for _, channel := range channels {
+		metrics.ChannelPackageCount.WithLabelValues(channel.Name, channel.System).Set(float64(channel.Packages))
+		if !channel.NixpkgsDate.IsZero() {
+			metrics.NixpkgsDate.WithLabelValues(channel.Name, channel.System, channel.Revision).Set(float64(channel.NixpkgsDate.Unix()))
+		}
+	}
+}
+
+// channel looks up an available channel by its name.
+func (cntr *Controller) channel(name string) (nixpkgs.Channel, bool) {
+	for _, channel := range cntr.channelList() {
+		if channel.Name == name {
+			return channel, true
+		}
+	}
+
+	return nixpkgs.Channel{}, false
 }
@@ -0,0 +1,69 @@
+package routes
+
+import (
+	"strings"
+	"time"
+
+	"github.com/TypicalAM/nix-hund/nixpkgs"
+	"github.com/charmbracelet/log"
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDelay is how long the watcher waits for the writes to a channel file to settle before reloading the channels.
+const watchDelay = 500 * time.Millisecond
+
+// WatchChannels reloads the channel list whenever a channel file in the channels directory is created, changed or removed.
+func (cntr *Controller) WatchChannels() error {
+	dir, err := nixpkgs.ChannelsDir(cntr.cacheDir)
+	if err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go cntr.watchChannels(watcher)
+	log.Info("Watching the channels directory", "dir", dir)
+	return nil
+}
+
+// watchChannels handles the watcher events, a burst of events causes a single reload after the writes have settled.
+func (cntr *Controller) watchChannels(watcher *fsnotify.Watcher) {
+	defer watcher.Close()
+
+	reload := time.NewTimer(watchDelay)
+	reload.Stop()
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+
+			// Temporary files of the refresh and the metadata files don't end with .json until they are renamed
+			if strings.HasSuffix(event.Name, ".json") && !event.Has(fsnotify.Chmod) {
+				reload.Reset(watchDelay)
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Error("Watching the channels failed", "err", err)
+
+		case <-reload.C:
+			if err := cntr.reloadChannels(); err != nil {
+				log.Error("Reloading the channels failed", "err", err)
+				continue
+			}
+			log.Info("Reloaded the channels", "count", len(cntr.channelList()))
+		}
+	}
+}
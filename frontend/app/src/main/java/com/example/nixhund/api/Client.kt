@@ -10,8 +10,10 @@ import io.ktor.client.request.header
 import io.ktor.client.request.post
 import io.ktor.client.request.setBody
 import io.ktor.http.ContentType.Application.Json
+import io.ktor.http.ParametersBuilder
 import io.ktor.http.contentType
 import io.ktor.serialization.kotlinx.json.json
+import kotlinx.coroutines.delay
 import kotlinx.serialization.json.Json
 
 class ApiClient(private val apiToken: String) {
@@ -42,20 +44,10 @@ class ApiClient(private val apiToken: String) {
     }
 
     suspend fun getChannelIndices(channelId: String): List<IndexInfo> {
-        val resp = client.get("$baseUrl/pkg/channel/index") {
-            header("Authorization", "Bearer $apiToken")
-            url { parameters.append("channel", channelId) }
-        }
-
-        if (resp.status.value > 400) {
-            val msg: String = resp.body()
-            throw Exception(msg)
-        }
-
-        return resp.body()
+        return getAllPages("$baseUrl/pkg/channel/index") { append("channel", channelId) }
     }
 
-    suspend fun generateIndex(channel: String): IndexGenerateResult {
+    suspend fun generateIndex(channel: String): IndexJob {
         val resp = client.post("$baseUrl/pkg/channel/index/generate") {
             header("Authorization", "Bearer $apiToken")
             contentType(Json)
@@ -67,13 +59,19 @@ class ApiClient(private val apiToken: String) {
             throw Exception(msg)
         }
 
-        return resp.body()
+        var job: IndexJob = resp.body()
+        while (job.state == "queued" || job.state == "running") {
+            delay(2000)
+            job = getIndexJob(job.id)
+        }
+
+        if (job.state == "failed") throw Exception(job.error)
+        return job
     }
 
-    suspend fun indexQuery(id: String, query: String): List<PkgResult> {
-        val resp = client.get("$baseUrl/pkg/index/$id/query") {
+    suspend fun getIndexJob(id: String): IndexJob {
+        val resp = client.get("$baseUrl/pkg/index/jobs/$id") {
             header("Authorization", "Bearer $apiToken")
-            url { parameters.append("query", query) }
         }
 
         if (resp.status.value > 400) {
@@ -84,28 +82,62 @@ class ApiClient(private val apiToken: String) {
         return resp.body()
     }
 
+    // Queries can match a lot of files, so the results are fetched a page at a time
+    suspend fun indexQuery(id: String, query: String, cursor: String? = null): Page<PkgResult> {
+        return getPage("$baseUrl/pkg/index/$id/query", cursor) { append("query", query) }
+    }
+
     suspend fun getHistoryList(): List<HistoryEntry> {
-        val resp = client.get("$baseUrl/account/history") {
+        return getAllPages("$baseUrl/account/history")
+    }
+
+    suspend fun deleteHistoryEntry(input: HistoryDeleteInput) {
+        val resp = client.post("$baseUrl/account/history/delete") {
             header("Authorization", "Bearer $apiToken")
+            setBody(input)
         }
 
         if (resp.status.value > 400) {
             val msg: String = resp.body()
             throw Exception(msg)
         }
+    }
 
-        return resp.body()
+    // Fetches every page of a paginated list by following the cursors
+    private suspend inline fun <reified T> getAllPages(
+        path: String,
+        crossinline params: ParametersBuilder.() -> Unit = {}
+    ): List<T> {
+        val items = mutableListOf<T>()
+        var cursor: String? = null
+        do {
+            val page: Page<T> = getPage(path, cursor) { params() }
+            items.addAll(page.items)
+            cursor = page.nextCursor
+        } while (cursor != null)
+
+        return items
     }
 
-    suspend fun deleteHistoryEntry(input: HistoryDeleteInput) {
-        val resp = client.post("$baseUrl/account/history/delete") {
+    // Fetches the page of a paginated list which starts at the cursor, the first page if there is none
+    private suspend inline fun <reified T> getPage(
+        path: String,
+        cursor: String?,
+        crossinline params: ParametersBuilder.() -> Unit = {}
+    ): Page<T> {
+        val resp = client.get(path) {
             header("Authorization", "Bearer $apiToken")
-            setBody(input)
+            url {
+                parameters.params()
+                cursor?.let { parameters.append("cursor", it) }
+            }
         }
 
         if (resp.status.value > 400) {
             val msg: String = resp.body()
             throw Exception(msg)
         }
+
+        return resp.body()
     }
 }
\ No newline at end of file
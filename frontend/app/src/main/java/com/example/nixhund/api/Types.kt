@@ -27,7 +27,17 @@ data class PkgResult(
     @SerialName("out_name") val outName: String,
     @SerialName("out_hash") val outHash: String,
     val path: String,
-    val version: String
+    val version: String,
+    val type: String = "regular",
+    val size: Long = 0,
+    val executable: Boolean = false,
+    val target: String? = null,
+    val cache: String? = null,
+    @SerialName("nar_size") val narSize: Long = 0,
+    @SerialName("file_size") val fileSize: Long = 0,
+    val deriver: String? = null,
+    val references: List<String> = emptyList(),
+    val verified: Boolean = false
 )
 
 @Serializable
@@ -41,11 +51,36 @@ data class HistoryEntry(
 data class IndexInfo(
     val id: String,
     @Serializable(DateSerializer::class) val date: Date,
+    val system: String = "x86_64-linux",
     @SerialName("total_file_count") val totalFileCount: Int,
+    @SerialName("failed_outputs") val failedOutputs: Int = 0,
+    val verify: String = "off",
 )
 
 @Serializable
-data class ChannelList(val channels: List<String>)
+data class Page<T>(
+    val items: List<T>,
+    val total: Int,
+    @SerialName("next_cursor") val nextCursor: String? = null,
+)
+
+@Serializable
+data class ChannelInfo(
+    val name: String,
+    val system: String,
+    val source: String? = null,
+    val version: String? = null,
+    val revision: String? = null,
+    @SerialName("nixpkgs_date") val nixpkgsDate: String? = null,
+    val evaluated: String? = null,
+    val packages: Int = 0,
+)
+
+@Serializable
+data class ChannelList(
+    val channels: List<String>,
+    val details: List<ChannelInfo> = emptyList(),
+)
 
 @Serializable
 data class IndexGenerateInput(val channel: String)
@@ -54,9 +89,13 @@ data class IndexGenerateInput(val channel: String)
 data class HistoryDeleteInput(val index: String)
 
 @Serializable
-data class IndexGenerateResult(
+data class IndexJob(
     val id: String,
-    val time: String,
-    @SerialName("total_package_count") val totalPackageCount: Int,
+    @SerialName("index_id") val indexID: String,
+    val channel: String,
+    val state: String,
+    @SerialName("processed_outputs") val processedOutputs: Int,
+    @SerialName("total_outputs") val totalOutputs: Int,
     @SerialName("total_file_count") val totalFileCount: Int,
+    val error: String? = null,
 )
@@ -29,6 +29,7 @@ import androidx.compose.material3.Scaffold
 import androidx.compose.material3.SnackbarHost
 import androidx.compose.material3.SnackbarHostState
 import androidx.compose.material3.Text
+import androidx.compose.material3.TextButton
 import androidx.compose.material3.TopAppBarDefaults
 import androidx.compose.material3.rememberDrawerState
 import androidx.compose.material3.rememberTopAppBarState
@@ -68,6 +69,9 @@ fun Search(navHostController: NavHostController, searchViewModel: SearchViewMode
     val client = ApiClient(getApiKey(LocalContext.current))
 
     var shownPkgs by remember { mutableStateOf<List<PkgResult>>(listOf()) }
+    var lastQuery by remember { mutableStateOf("") }
+    var nextCursor by remember { mutableStateOf<String?>(null) }
+    var isLoadingMore by remember { mutableStateOf(false) }
     var isSearching by remember { mutableStateOf(false) }
     var isLoading by remember { mutableStateOf(false) }
 
@@ -95,8 +99,11 @@ fun Search(navHostController: NavHostController, searchViewModel: SearchViewMode
                     isLoading = true
                     val uuid = searchViewModel.currentIndex!!.id
                     var pkgs: List<PkgResult> = listOf()
+                    var cursor: String? = null
                     try {
-                        pkgs = client.indexQuery(uuid, query)
+                        val page = client.indexQuery(uuid, query)
+                        pkgs = page.items
+                        cursor = page.nextCursor
                         isLoading = false
                     } catch (e: Exception) {
                         snackbarHostState.showSnackbar("An error occurred when fetching the packages")
@@ -104,6 +111,8 @@ fun Search(navHostController: NavHostController, searchViewModel: SearchViewMode
                     }
 
                     shownPkgs = pkgs
+                    lastQuery = query
+                    nextCursor = cursor
                     isLoading = false
                     Log.d("search", "Found ${pkgs.size} results")
                 }
@@ -156,6 +165,32 @@ fun Search(navHostController: NavHostController, searchViewModel: SearchViewMode
                                     navHostController.navigate("detail")
                                 })
                             }
+
+                            if (nextCursor != null) {
+                                item {
+                                    if (isLoadingMore) {
+                                        CircularProgressIndicator(
+                                            modifier = Modifier.padding(16.dp),
+                                        )
+                                    } else {
+                                        TextButton(onClick = {
+                                            scope.launch {
+                                                isLoadingMore = true
+                                                try {
+                                                    val page = client.indexQuery(searchViewModel.currentIndex!!.id, lastQuery, nextCursor)
+                                                    shownPkgs = shownPkgs + page.items
+                                                    nextCursor = page.nextCursor
+                                                } catch (e: Exception) {
+                                                    snackbarHostState.showSnackbar("An error occurred when fetching the packages")
+                                                }
+                                                isLoadingMore = false
+                                            }
+                                        }, modifier = Modifier.padding(16.dp)) {
+                                            Text("Load more")
+                                        }
+                                    }
+                                }
+                            }
                         }
                     }
                 }